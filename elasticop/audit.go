@@ -0,0 +1,80 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// auditMappings defines the mappings of the index where the audit records are stored.
+var auditMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"timestamp": map[string]interface{}{"type": "date"},
+		"project":   map[string]interface{}{"type": "keyword"},
+		"workspace": map[string]interface{}{"type": "keyword"},
+		"action":    map[string]interface{}{"type": "keyword"},
+		"user":      map[string]interface{}{"type": "keyword"},
+		"reason":    map[string]interface{}{"type": "text"},
+		"details":   map[string]interface{}{"type": "object", "enabled": false},
+	},
+}
+
+// AuditRecord represents an administrative action recorded in Elasticsearch.
+type AuditRecord struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Project   string                 `json:"project"`
+	Workspace string                 `json:"workspace"`
+	Action    string                 `json:"action"`
+	User      string                 `json:"user"`
+	Reason    string                 `json:"reason"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// WriteAudit stores an audit record of an administrative action on the project and workspace.
+func (e *Elastic) WriteAudit(action, user, reason string, details map[string]interface{}) error {
+	var buf bytes.Buffer
+	record := AuditRecord{
+		Timestamp: time.Now().UTC(),
+		Project:   e.Project,
+		Workspace: e.Workspace,
+		Action:    action,
+		User:      user,
+		Reason:    reason,
+		Details:   details,
+	}
+
+	// Make sure the audit index exists with the proper mappings.
+	if err := e.ensureIndex(e.AuditIndex, auditMappings); err != nil {
+		return err
+	}
+
+	// Encode the audit record.
+	if err := json.NewEncoder(&buf).Encode(record); err != nil {
+		e.Logger.Error("Error encoding audit record", zap.Error(err))
+		return err
+	}
+
+	// Save the audit record to Elasticsearch.
+	res, err := e.Client.Index(
+		e.AuditIndex,
+		&buf,
+		e.Client.Index.WithContext(e.Ctx),
+		e.Client.Index.WithRefresh("true"),
+	)
+	if err != nil {
+		e.Logger.Error("Error saving audit record to Elasticsearch", zap.Error(err))
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		e.Logger.Error("Failed to save audit record", zap.Int("status_code", res.StatusCode))
+		return fmt.Errorf("error saving audit record: %s", res.String())
+	}
+
+	e.Logger.Info("Audit record saved", zap.String("action", action), zap.String("user", user), zap.String("project", e.Project))
+	return nil
+}
@@ -0,0 +1,140 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// stateDocumentMappings defines the mappings of the fields the backend adds to state and resource documents.
+var stateDocumentMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"project":        map[string]interface{}{"type": "keyword"},
+		"workspace":      map[string]interface{}{"type": "keyword"},
+		"timestamp":      map[string]interface{}{"type": "date"},
+		"generation":     map[string]interface{}{"type": "keyword"},
+		"previous":       map[string]interface{}{"type": "keyword"},
+		"position":       map[string]interface{}{"type": "long"},
+		"committed":      map[string]interface{}{"type": "boolean"},
+		"author":         map[string]interface{}{"type": "keyword"},
+		"serial":         map[string]interface{}{"type": "long"},
+		"lineage":        map[string]interface{}{"type": "keyword"},
+		"resource_count": map[string]interface{}{"type": "long"},
+		"size":           map[string]interface{}{"type": "long"},
+		"deleted":        map[string]interface{}{"type": "boolean"},
+		"raw_state":      rawStateMappings,
+	},
+}
+
+// bootstrappedIndices records the indices which are known to exist, keyed by cluster addresses and index name,
+// so the existence check is only performed once per process.
+var bootstrappedIndices sync.Map
+
+// ensureIndex creates the given index with the provided mappings if it doesn't exist yet.
+// An index created concurrently by another instance is not treated as an error.
+// If the index already exists, the mappings are added to it, so fields introduced later are mapped as well.
+func (e *Elastic) ensureIndex(index string, mappings map[string]interface{}) error {
+	key := strings.Join(e.Addresses, ",") + "|" + e.CloudID + "|" + index
+	if _, ok := bootstrappedIndices.Load(key); ok {
+		return nil
+	}
+
+	// Check whether the index already exists.
+	res, err := e.Client.Indices.Exists(
+		[]string{index},
+		e.Client.Indices.Exists.WithContext(e.Ctx),
+	)
+	if err != nil {
+		e.Logger.Error("Error checking the index", zap.String("index", index), zap.Error(err))
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		var buf bytes.Buffer
+
+		// Encode the index mappings.
+		if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"mappings": mappings}); err != nil {
+			e.Logger.Error("Error encoding index mappings", zap.Error(err))
+			return err
+		}
+
+		// Create the index with the mappings.
+		res, err := e.Client.Indices.Create(
+			index,
+			e.Client.Indices.Create.WithContext(e.Ctx),
+			e.Client.Indices.Create.WithBody(&buf),
+		)
+		if err != nil {
+			e.Logger.Error("Error creating the index", zap.String("index", index), zap.Error(err))
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.IsError() && !strings.Contains(res.String(), "resource_already_exists_exception") {
+			e.Logger.Error("Failed to create the index", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+			return fmt.Errorf("failed to create index %s: %s", index, res.String())
+		}
+		e.Logger.Info("Index created", zap.String("index", index))
+	} else if res.IsError() {
+		e.Logger.Error("Failed to check the index", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+		return fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	} else {
+		var buf bytes.Buffer
+
+		// Encode the index mappings.
+		if err := json.NewEncoder(&buf).Encode(mappings); err != nil {
+			e.Logger.Error("Error encoding index mappings", zap.Error(err))
+			return err
+		}
+
+		// Add the mappings to the existing index. Conflicting existing mappings are kept.
+		res, err := e.Client.Indices.PutMapping(
+			[]string{index},
+			&buf,
+			e.Client.Indices.PutMapping.WithContext(e.Ctx),
+		)
+		if err != nil {
+			e.Logger.Error("Error updating the index mappings", zap.String("index", index), zap.Error(err))
+			return err
+		}
+		defer res.Body.Close()
+
+		if res.IsError() {
+			e.Logger.Warn("Failed to update the index mappings", zap.String("index", index), zap.String("response", res.String()))
+		}
+	}
+
+	bootstrappedIndices.Store(key, true)
+	return nil
+}
+
+// scopeDocumentID returns the ID of the documents which exist once per project and workspace, like locks.
+// The default workspace uses the project name alone, matching locks created before workspaces were supported.
+func (e *Elastic) scopeDocumentID() string {
+	if e.Workspace == "" || e.Workspace == DefaultWorkspace {
+		return e.Project
+	}
+	return e.Project + "@" + e.Workspace
+}
+
+// scopeQuery returns a query which matches the documents of the project and workspace,
+// combined with the additional filters.
+func (e *Elastic) scopeQuery(filters ...map[string]interface{}) map[string]interface{} {
+	filter := []map[string]interface{}{
+		{"term": map[string]interface{}{"project": e.Project}},
+		{"term": map[string]interface{}{"workspace": e.Workspace}},
+	}
+	filter = append(filter, filters...)
+
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": filter,
+		},
+	}
+}
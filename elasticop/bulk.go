@@ -0,0 +1,171 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Defaults of the bulk request limits, used when they are not configured.
+const (
+	defaultBulkBatchSize  = 500
+	defaultBulkFlushBytes = 5 * 1024 * 1024
+)
+
+// maxReportedBulkErrors is the number of failed items whose reasons are included in the returned error.
+const maxReportedBulkErrors = 5
+
+// bulkItemError describes a document which Elasticsearch failed to index.
+type bulkItemError struct {
+	// Position is the position of the document in the indexed slice.
+	Position int
+	Status   int
+	Type     string
+	Reason   string
+}
+
+// bulkIndex indexes the documents into the index using the Bulk API. Documents are sent in batches
+// bounded by the configured batch size and flush bytes, without refreshing the index.
+// Every failed document is logged, and an error summarizing the failures is returned.
+func (e *Elastic) bulkIndex(index string, docs []map[string]interface{}) error {
+	batchSize := e.BulkBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBulkBatchSize
+	}
+	flushBytes := e.BulkFlushBytes
+	if flushBytes <= 0 {
+		flushBytes = defaultBulkFlushBytes
+	}
+
+	var buf bytes.Buffer
+	var failed []bulkItemError
+	first, count := 0, 0
+
+	// flush sends the documents collected in the buffer since the position of the first one.
+	flush := func() error {
+		if count == 0 {
+			return nil
+		}
+		itemErrors, err := e.sendBulk(&buf, first)
+		if err != nil {
+			return err
+		}
+		failed = append(failed, itemErrors...)
+		buf.Reset()
+		first += count
+		count = 0
+		return nil
+	}
+
+	for _, doc := range docs {
+		// Encode the action and the document.
+		if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"index": map[string]interface{}{"_index": index}}); err != nil {
+			e.Logger.Error("Error encoding bulk action", zap.Error(err))
+			return err
+		}
+		if err := json.NewEncoder(&buf).Encode(doc); err != nil {
+			e.Logger.Error("Error encoding document", zap.Error(err))
+			return err
+		}
+		count++
+
+		if count >= batchSize || buf.Len() >= flushBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	// Report the failed documents.
+	reasons := []string{}
+	for i, item := range failed {
+		e.Logger.Error("Failed to index document", zap.String("index", index), zap.Int("position", item.Position),
+			zap.Int("status_code", item.Status), zap.String("type", item.Type), zap.String("reason", item.Reason))
+		if i < maxReportedBulkErrors {
+			reasons = append(reasons, fmt.Sprintf("document %d: %s: %s", item.Position, item.Type, item.Reason))
+		}
+	}
+	return fmt.Errorf("failed to index %d of %d documents: %s", len(failed), len(docs), strings.Join(reasons, "; "))
+}
+
+// sendBulk sends a single bulk request and returns the items which failed.
+// The positions of the items are offset by the position of the first document in the request.
+func (e *Elastic) sendBulk(body *bytes.Buffer, first int) ([]bulkItemError, error) {
+	res, err := e.Client.Bulk(
+		bytes.NewReader(body.Bytes()),
+		e.Client.Bulk.WithContext(e.Ctx),
+	)
+	if err != nil {
+		e.Logger.Error("Error sending bulk request to Elasticsearch", zap.Error(err))
+		return nil, fmt.Errorf("error sending bulk request: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		e.Logger.Error("Bulk request failed", zap.Int("status_code", res.StatusCode))
+		return nil, fmt.Errorf("bulk request failed: %s", res.String())
+	}
+
+	// Parse the response to find the failed items.
+	var r struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the bulk response", zap.Error(err))
+		return nil, err
+	}
+	if !r.Errors {
+		return nil, nil
+	}
+
+	var failed []bulkItemError
+	for i, item := range r.Items {
+		for _, result := range item {
+			if result.Status >= 300 {
+				failed = append(failed, bulkItemError{
+					Position: first + i,
+					Status:   result.Status,
+					Type:     result.Error.Type,
+					Reason:   result.Error.Reason,
+				})
+			}
+		}
+	}
+	return failed, nil
+}
+
+// refreshIndex makes the documents indexed so far visible to searches.
+func (e *Elastic) refreshIndex(index string) error {
+	res, err := e.Client.Indices.Refresh(
+		e.Client.Indices.Refresh.WithContext(e.Ctx),
+		e.Client.Indices.Refresh.WithIndex(index),
+	)
+	if err != nil {
+		e.Logger.Error("Error refreshing the index", zap.String("index", index), zap.Error(err))
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		e.Logger.Error("Failed to refresh the index", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+		return fmt.Errorf("error refreshing index %s: %s", index, res.String())
+	}
+	return nil
+}
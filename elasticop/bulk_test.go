@@ -0,0 +1,78 @@
+package elasticop
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// bulkDocuments returns documents with their position in the slice.
+func bulkDocuments(count int) []map[string]interface{} {
+	docs := make([]map[string]interface{}, count)
+	for i := range docs {
+		docs[i] = map[string]interface{}{"position": i}
+	}
+	return docs
+}
+
+func TestBulkIndexBatches(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// The documents are sent in batches of the configured size.
+	e.BulkBatchSize = 3
+	if err := e.bulkIndex("batched", bulkDocuments(10)); err != nil {
+		t.Fatalf("bulkIndex failed: %s", err)
+	}
+	if cluster.bulks != 4 {
+		t.Fatalf("expected 4 bulk requests, got %d", cluster.bulks)
+	}
+	if docs := cluster.documents("batched"); len(docs) != 10 {
+		t.Fatalf("expected 10 documents, got %d", len(docs))
+	}
+
+	// A batch is also sent once it reaches the flush bytes.
+	cluster.bulks = 0
+	e.BulkBatchSize = 100
+	e.BulkFlushBytes = 1
+	if err := e.bulkIndex("flushed", bulkDocuments(5)); err != nil {
+		t.Fatalf("bulkIndex failed: %s", err)
+	}
+	if cluster.bulks != 5 {
+		t.Fatalf("expected a bulk request per document, got %d", cluster.bulks)
+	}
+}
+
+func TestBulkIndexReportsFailedItems(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	e.BulkBatchSize = 4
+
+	// Every other document fails, across several batches.
+	cluster.rejectDocument = func(source map[string]interface{}) bool {
+		return int(source["position"].(float64))%2 == 1
+	}
+	err := e.bulkIndex("failing", bulkDocuments(12))
+	if err == nil {
+		t.Fatal("expected the failed documents to be reported")
+	}
+
+	// The error counts every failure, and names the first ones by their position in the slice.
+	message := err.Error()
+	if !strings.Contains(message, "failed to index 6 of 12 documents") {
+		t.Fatalf("expected the failures to be counted, got %s", message)
+	}
+	for _, position := range []int{1, 3, 5, 7, 9} {
+		if !strings.Contains(message, fmt.Sprintf("document %d: mapper_parsing_exception: rejected", position)) {
+			t.Errorf("expected document %d to be reported, got %s", position, message)
+		}
+	}
+	if strings.Contains(message, "document 11:") {
+		t.Errorf("expected only the first %d failures to be named, got %s", maxReportedBulkErrors, message)
+	}
+
+	// The other documents are indexed.
+	if docs := cluster.documents("failing"); len(docs) != 6 {
+		t.Fatalf("expected 6 documents to be indexed, got %d", len(docs))
+	}
+}
@@ -0,0 +1,743 @@
+package elasticop
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"go.uber.org/zap"
+)
+
+// fakeDocument is a document stored in the fake cluster.
+type fakeDocument struct {
+	id     string
+	source map[string]interface{}
+	seqNo  int64
+
+	// order is the position in which the document was first indexed, used as _shard_doc.
+	order int64
+}
+
+// fakeCluster emulates the parts of the Elasticsearch API used by the backend, keeping the documents in memory.
+// Writes are serialized and guarded by sequence numbers like in Elasticsearch: op_type=create fails with a
+// conflict if the document exists, and if_seq_no fails with a conflict if the document changed.
+// Point in time IDs change with every search, and searches with an outdated ID fail.
+type fakeCluster struct {
+	mu      sync.Mutex
+	indices map[string]map[string]*fakeDocument
+	seqNo   int64
+	order   int64
+	nextID  int
+
+	// pits maps the current ID of each open point in time to its index.
+	pits    map[string]string
+	nextPIT int
+
+	// searches counts the search requests, and stalePIT the searches with an outdated point in time ID.
+	searches int
+	stalePIT int
+
+	// bulks counts the bulk requests, and rejectDocument reports the documents which bulk requests fail to index.
+	bulks          int
+	rejectDocument func(source map[string]interface{}) bool
+
+	// failUpdates is the number of partial updates which fail.
+	failUpdates int
+
+	// phantomConflicts is the number of creations which fail with a conflict although the document doesn't
+	// exist, as if it was deleted before the client could read it.
+	phantomConflicts int
+
+	// templates maps the index patterns of the installed index templates to their mappings.
+	templates map[string]map[string]interface{}
+}
+
+// maxTermBytes is the size limit of the terms Elasticsearch indexes.
+const maxTermBytes = 32766
+
+// newFakeCluster starts a fake cluster, which is stopped when the test ends.
+func newFakeCluster(t *testing.T) (*fakeCluster, *httptest.Server) {
+	t.Helper()
+	cluster := &fakeCluster{
+		indices:   map[string]map[string]*fakeDocument{},
+		pits:      map[string]string{},
+		templates: map[string]map[string]interface{}{},
+	}
+	server := httptest.NewServer(http.HandlerFunc(cluster.serve))
+	t.Cleanup(server.Close)
+	return cluster, server
+}
+
+// newTestElastic returns a client of the fake cluster for the project and workspace.
+func newTestElastic(t *testing.T, server *httptest.Server, project, workspace string) *Elastic {
+	t.Helper()
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	return &Elastic{
+		Client:           client,
+		Ctx:              context.Background(),
+		Addresses:        []string{server.URL},
+		StateIndex:       "terraform-state",
+		ResourceIndex:    "terraform-resources",
+		PointerIndex:     "terraform-state-pointers",
+		LockIndex:        "terraform-locks",
+		LockHistoryIndex: "terraform-lock-history",
+		AuditIndex:       "terraform-audit",
+		Project:          project,
+		Workspace:        workspace,
+		Logger:           zap.NewNop(),
+	}
+}
+
+// documents returns the documents of the index in the order they were indexed.
+func (c *fakeCluster) documents(index string) []*fakeDocument {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var docs []*fakeDocument
+	for _, doc := range c.indices[index] {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].order < docs[j].order })
+	return docs
+}
+
+// put stores a document directly in the index.
+func (c *fakeCluster) put(index, id string, source map[string]interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store(index, id, source)
+}
+
+// store indexes the document and returns it. It must be called with the lock held.
+func (c *fakeCluster) store(index, id string, source map[string]interface{}) *fakeDocument {
+	if c.indices[index] == nil {
+		c.indices[index] = map[string]*fakeDocument{}
+	}
+	if id == "" {
+		c.nextID++
+		id = "auto-" + strconv.Itoa(c.nextID)
+	}
+	c.seqNo++
+	doc, ok := c.indices[index][id]
+	if !ok {
+		c.order++
+		doc = &fakeDocument{id: id, order: c.order}
+		c.indices[index][id] = doc
+	}
+	doc.source = source
+	doc.seqNo = c.seqNo
+	return doc
+}
+
+// serve dispatches the requests of the client.
+func (c *fakeCluster) serve(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "_bulk":
+		c.bulk(w, body.Bytes())
+	case parts[0] == "_search":
+		c.search(w, "", body.Bytes())
+	case parts[0] == "_pit" && r.Method == http.MethodDelete:
+		c.closePIT(w, body.Bytes())
+	case parts[0] == "_index_template" && r.Method == http.MethodPut:
+		c.putTemplate(w, body.Bytes())
+	case len(parts) == 1 && r.Method == http.MethodHead:
+		if _, ok := c.indices[parts[0]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		if c.indices[parts[0]] == nil {
+			c.indices[parts[0]] = map[string]*fakeDocument{}
+		}
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case len(parts) == 2 && parts[1] == "_search":
+		c.search(w, parts[0], body.Bytes())
+	case len(parts) == 2 && parts[1] == "_delete_by_query":
+		c.deleteByQuery(w, parts[0], body.Bytes())
+	case len(parts) == 2 && parts[1] == "_pit":
+		c.openPIT(w, parts[0])
+	case len(parts) == 2 && (parts[1] == "_refresh" || parts[1] == "_mapping"):
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case len(parts) == 2 && parts[1] == "_doc":
+		c.index(w, r, parts[0], "", body.Bytes(), false)
+	case len(parts) == 3 && parts[1] == "_update":
+		c.update(w, r, parts[0], parts[2], body.Bytes())
+	case len(parts) == 3 && parts[1] == "_create":
+		c.index(w, r, parts[0], parts[2], body.Bytes(), true)
+	case len(parts) == 3 && parts[1] == "_doc" && r.Method == http.MethodGet:
+		c.get(w, parts[0], parts[2])
+	case len(parts) == 3 && parts[1] == "_doc" && r.Method == http.MethodDelete:
+		c.delete(w, r, parts[0], parts[2])
+	case len(parts) == 3 && parts[1] == "_doc":
+		c.index(w, r, parts[0], parts[2], body.Bytes(), r.URL.Query().Get("op_type") == "create")
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":{"type":"unsupported","reason":"%s %s"}}`, r.Method, r.URL.Path)
+	}
+}
+
+// writeError writes an Elasticsearch error response.
+func writeError(w http.ResponseWriter, status int, errorType string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"type":%q,"reason":%q},"status":%d}`, errorType, errorType, status)
+}
+
+// checkWrite checks the create and sequence number conditions of a write to the document,
+// and returns the status of the failure, or 0 if the write can proceed.
+func (c *fakeCluster) checkWrite(index, id string, create bool, ifSeqNo string) int {
+	existing := c.indices[index][id]
+	if create && existing != nil {
+		return http.StatusConflict
+	}
+	if create && c.phantomConflicts > 0 {
+		c.phantomConflicts--
+		return http.StatusConflict
+	}
+	if ifSeqNo != "" {
+		if existing == nil {
+			if create {
+				return 0
+			}
+			return http.StatusConflict
+		}
+		if strconv.FormatInt(existing.seqNo, 10) != ifSeqNo {
+			return http.StatusConflict
+		}
+	}
+	return 0
+}
+
+// index handles the creation or replacement of a document.
+func (c *fakeCluster) index(w http.ResponseWriter, r *http.Request, index, id string, body []byte, create bool) {
+	var source map[string]interface{}
+	if err := json.Unmarshal(body, &source); err != nil {
+		writeError(w, http.StatusBadRequest, "mapper_parsing_exception")
+		return
+	}
+	if status := c.checkWrite(index, id, create, r.URL.Query().Get("if_seq_no")); status != 0 {
+		writeError(w, status, "version_conflict_engine_exception")
+		return
+	}
+	if c.immenseTerm(index, source) {
+		writeError(w, http.StatusBadRequest, "illegal_argument_exception")
+		return
+	}
+
+	result, status := "updated", http.StatusOK
+	if c.indices[index][id] == nil {
+		result, status = "created", http.StatusCreated
+	}
+	doc := c.store(index, id, source)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"_index": index, "_id": doc.id, "_seq_no": doc.seqNo, "_primary_term": 1, "result": result,
+	})
+}
+
+// putTemplate installs an index template, whose mappings apply to the documents of the matching indices.
+func (c *fakeCluster) putTemplate(w http.ResponseWriter, body []byte) {
+	var template struct {
+		IndexPatterns []string `json:"index_patterns"`
+		Template      struct {
+			Mappings map[string]interface{} `json:"mappings"`
+		} `json:"template"`
+	}
+	if err := json.Unmarshal(body, &template); err != nil {
+		writeError(w, http.StatusBadRequest, "parse_exception")
+		return
+	}
+	for _, pattern := range template.IndexPatterns {
+		c.templates[pattern] = template.Template.Mappings
+	}
+	fmt.Fprint(w, `{"acknowledged":true}`)
+}
+
+// immenseTerm reports whether the document holds a value of a flattened field which Elasticsearch fails to
+// index, as it exceeds the size of a term and the field doesn't ignore values above it.
+func (c *fakeCluster) immenseTerm(index string, source map[string]interface{}) bool {
+	properties, _ := c.templates[index]["properties"].(map[string]interface{})
+	for name, property := range properties {
+		mapping, _ := property.(map[string]interface{})
+		if mapping["type"] != "flattened" {
+			continue
+		}
+		if ignoreAbove, ok := mapping["ignore_above"].(float64); ok && ignoreAbove*4 <= maxTermBytes {
+			continue
+		}
+		if exceedsTerm(source[name]) {
+			return true
+		}
+	}
+	return false
+}
+
+// exceedsTerm reports whether a leaf value of the object exceeds the size of a term.
+func exceedsTerm(value interface{}) bool {
+	switch typed := value.(type) {
+	case string:
+		return len(typed) > maxTermBytes
+	case map[string]interface{}:
+		for _, item := range typed {
+			if exceedsTerm(item) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range typed {
+			if exceedsTerm(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// update handles the partial update of a document.
+func (c *fakeCluster) update(w http.ResponseWriter, r *http.Request, index, id string, body []byte) {
+	var req struct {
+		Doc map[string]interface{} `json:"doc"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "parse_exception")
+		return
+	}
+	existing := c.indices[index][id]
+	if existing == nil {
+		writeError(w, http.StatusNotFound, "document_missing_exception")
+		return
+	}
+	if c.failUpdates > 0 {
+		c.failUpdates--
+		writeError(w, http.StatusInternalServerError, "exception")
+		return
+	}
+
+	source := map[string]interface{}{}
+	for key, value := range existing.source {
+		source[key] = value
+	}
+	for key, value := range req.Doc {
+		source[key] = value
+	}
+	doc := c.store(index, id, source)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"_index": index, "_id": doc.id, "_seq_no": doc.seqNo, "_primary_term": 1, "result": "updated",
+	})
+}
+
+// get handles the retrieval of a document.
+func (c *fakeCluster) get(w http.ResponseWriter, index, id string) {
+	doc := c.indices[index][id]
+	if doc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"_index":%q,"_id":%q,"found":false}`, index, id)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"_index": index, "_id": id, "_seq_no": doc.seqNo, "_primary_term": 1, "found": true, "_source": doc.source,
+	})
+}
+
+// delete handles the deletion of a document.
+func (c *fakeCluster) delete(w http.ResponseWriter, r *http.Request, index, id string) {
+	if c.indices[index][id] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"_index":%q,"_id":%q,"result":"not_found"}`, index, id)
+		return
+	}
+	if status := c.checkWrite(index, id, false, r.URL.Query().Get("if_seq_no")); status != 0 {
+		writeError(w, status, "version_conflict_engine_exception")
+		return
+	}
+	delete(c.indices[index], id)
+	c.seqNo++
+	fmt.Fprintf(w, `{"_index":%q,"_id":%q,"result":"deleted"}`, index, id)
+}
+
+// deleteByQuery handles the deletion of the documents matching a query.
+func (c *fakeCluster) deleteByQuery(w http.ResponseWriter, index string, body []byte) {
+	var req struct {
+		Query map[string]interface{} `json:"query"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "parse_exception")
+		return
+	}
+	if _, ok := c.indices[index]; !ok {
+		writeError(w, http.StatusNotFound, "index_not_found_exception")
+		return
+	}
+	deleted := 0
+	for id, doc := range c.indices[index] {
+		if matchQuery(req.Query, doc.source) {
+			delete(c.indices[index], id)
+			deleted++
+		}
+	}
+	c.seqNo++
+	fmt.Fprintf(w, `{"deleted":%d}`, deleted)
+}
+
+// bulk handles bulk index and create actions.
+func (c *fakeCluster) bulk(w http.ResponseWriter, body []byte) {
+	var items []map[string]interface{}
+	hasErrors := false
+	c.bulks++
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var action map[string]struct {
+			Index   string `json:"_index"`
+			ID      string `json:"_id"`
+			IfSeqNo *int64 `json:"if_seq_no"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+			writeError(w, http.StatusBadRequest, "parse_exception")
+			return
+		}
+		scanner.Scan()
+		var source map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &source); err != nil {
+			writeError(w, http.StatusBadRequest, "parse_exception")
+			return
+		}
+
+		for op, meta := range action {
+			ifSeqNo := ""
+			if meta.IfSeqNo != nil {
+				ifSeqNo = strconv.FormatInt(*meta.IfSeqNo, 10)
+			}
+			item := map[string]interface{}{"_index": meta.Index, "_id": meta.ID}
+			if status := c.checkWrite(meta.Index, meta.ID, op == "create", ifSeqNo); status != 0 {
+				hasErrors = true
+				item["status"] = status
+				item["error"] = map[string]interface{}{"type": "version_conflict_engine_exception", "reason": "conflict"}
+			} else if c.immenseTerm(meta.Index, source) {
+				hasErrors = true
+				item["status"] = http.StatusBadRequest
+				item["error"] = map[string]interface{}{"type": "illegal_argument_exception", "reason": "immense term"}
+			} else if c.rejectDocument != nil && c.rejectDocument(source) {
+				hasErrors = true
+				item["status"] = http.StatusBadRequest
+				item["error"] = map[string]interface{}{"type": "mapper_parsing_exception", "reason": "rejected"}
+			} else {
+				doc := c.store(meta.Index, meta.ID, source)
+				item["_id"] = doc.id
+				item["status"] = http.StatusCreated
+			}
+			items = append(items, map[string]interface{}{op: item})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": hasErrors, "items": items})
+}
+
+// openPIT opens a point in time on the index.
+func (c *fakeCluster) openPIT(w http.ResponseWriter, index string) {
+	if _, ok := c.indices[index]; !ok {
+		writeError(w, http.StatusNotFound, "index_not_found_exception")
+		return
+	}
+	c.nextPIT++
+	id := "pit-" + strconv.Itoa(c.nextPIT)
+	c.pits[id] = index
+	fmt.Fprintf(w, `{"id":%q}`, id)
+}
+
+// closePIT closes a point in time.
+func (c *fakeCluster) closePIT(w http.ResponseWriter, body []byte) {
+	var req struct {
+		ID string `json:"id"`
+	}
+	json.Unmarshal(body, &req)
+	if _, ok := c.pits[req.ID]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"succeeded":false,"num_freed":0}`)
+		return
+	}
+	delete(c.pits, req.ID)
+	fmt.Fprint(w, `{"succeeded":true,"num_freed":1}`)
+}
+
+// openPITs returns the number of points in time which are still open.
+func (c *fakeCluster) openPITs() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.pits)
+}
+
+// search handles searches on an index or a point in time, supporting sorting and search_after.
+func (c *fakeCluster) search(w http.ResponseWriter, index string, body []byte) {
+	var req struct {
+		Query       map[string]interface{}   `json:"query"`
+		Size        *int                     `json:"size"`
+		Sort        []map[string]interface{} `json:"sort"`
+		SearchAfter []interface{}            `json:"search_after"`
+		PIT         *struct {
+			ID string `json:"id"`
+		} `json:"pit"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "parse_exception")
+		return
+	}
+	c.searches++
+
+	// A point in time gets a new ID with every search, and the outdated ID can't be used anymore.
+	var pitID string
+	if req.PIT != nil {
+		pitIndex, ok := c.pits[req.PIT.ID]
+		if !ok {
+			c.stalePIT++
+			writeError(w, http.StatusNotFound, "search_context_missing_exception")
+			return
+		}
+		delete(c.pits, req.PIT.ID)
+		c.nextPIT++
+		pitID = "pit-" + strconv.Itoa(c.nextPIT)
+		c.pits[pitID] = pitIndex
+		index = pitIndex
+	}
+	if _, ok := c.indices[index]; !ok {
+		writeError(w, http.StatusNotFound, "index_not_found_exception")
+		return
+	}
+
+	// Collect the matching documents and their sort values.
+	type hit struct {
+		doc  *fakeDocument
+		sort []interface{}
+	}
+	var hits []hit
+	for _, doc := range c.indices[index] {
+		if !matchQuery(req.Query, doc.source) {
+			continue
+		}
+		var values []interface{}
+		for _, field := range req.Sort {
+			for name := range field {
+				if name == "_shard_doc" {
+					values = append(values, doc.order)
+				} else {
+					values = append(values, lookupField(doc.source, name))
+				}
+			}
+		}
+		hits = append(hits, hit{doc: doc, sort: values})
+	}
+
+	// compare compares the sort values, taking the order of each sort field into account.
+	compare := func(a, b []interface{}) int {
+		for i, field := range req.Sort {
+			for _, options := range field {
+				result := compareValues(a[i], b[i])
+				if order, _ := options.(map[string]interface{})["order"].(string); order == "desc" {
+					result = -result
+				}
+				if result != 0 {
+					return result
+				}
+			}
+		}
+		return 0
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if result := compare(hits[i].sort, hits[j].sort); result != 0 {
+			return result < 0
+		}
+		return hits[i].doc.order < hits[j].doc.order
+	})
+
+	// Skip the hits up to the search_after values, which doesn't change the total.
+	total := len(hits)
+	if req.SearchAfter != nil {
+		start := 0
+		for start < len(hits) && compare(hits[start].sort, req.SearchAfter) <= 0 {
+			start++
+		}
+		hits = hits[start:]
+	}
+
+	size := 10
+	if req.Size != nil {
+		size = *req.Size
+	}
+	if len(hits) > size {
+		hits = hits[:size]
+	}
+
+	results := []map[string]interface{}{}
+	for _, h := range hits {
+		results = append(results, map[string]interface{}{
+			"_index": index, "_id": h.doc.id, "_seq_no": h.doc.seqNo, "_primary_term": 1, "_source": h.doc.source, "sort": h.sort,
+		})
+	}
+	response := map[string]interface{}{
+		"hits": map[string]interface{}{"total": map[string]interface{}{"value": total}, "hits": results},
+	}
+	if pitID != "" {
+		response["pit_id"] = pitID
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// matchQuery evaluates the subset of the query DSL used by the backend against the document.
+func matchQuery(query map[string]interface{}, source map[string]interface{}) bool {
+	for kind, clause := range query {
+		switch kind {
+		case "match_all":
+		case "bool":
+			b, _ := clause.(map[string]interface{})
+			for _, occur := range []string{"filter", "must"} {
+				for _, q := range clauseList(b[occur]) {
+					if !matchQuery(q, source) {
+						return false
+					}
+				}
+			}
+			for _, q := range clauseList(b["must_not"]) {
+				if matchQuery(q, source) {
+					return false
+				}
+			}
+		case "term", "match":
+			for field, value := range clause.(map[string]interface{}) {
+				if options, ok := value.(map[string]interface{}); ok {
+					value = options["value"]
+				}
+				if compareValues(lookupField(source, field), value) != 0 {
+					return false
+				}
+			}
+		case "terms":
+			for field, values := range clause.(map[string]interface{}) {
+				found := false
+				for _, value := range values.([]interface{}) {
+					if compareValues(lookupField(source, field), value) == 0 {
+						found = true
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+		case "range":
+			for field, bounds := range clause.(map[string]interface{}) {
+				value := lookupField(source, field)
+				if value == nil {
+					return false
+				}
+				for op, bound := range bounds.(map[string]interface{}) {
+					result := compareValues(value, rangeBound(bound))
+					if (op == "lt" && result >= 0) || (op == "lte" && result > 0) || (op == "gt" && result <= 0) || (op == "gte" && result < 0) {
+						return false
+					}
+				}
+			}
+		case "exists":
+			field, _ := clause.(map[string]interface{})["field"].(string)
+			if lookupField(source, field) == nil {
+				return false
+			}
+		default:
+			panic("unsupported query: " + kind)
+		}
+	}
+	return true
+}
+
+// rangeBound resolves date math relative to now, like now-1h, to a timestamp, and returns other bounds as they are.
+func rangeBound(bound interface{}) interface{} {
+	s, ok := bound.(string)
+	if !ok || !strings.HasPrefix(s, "now") {
+		return bound
+	}
+	offset, err := time.ParseDuration(strings.TrimPrefix(s, "now"))
+	if s == "now" {
+		offset, err = 0, nil
+	}
+	if err != nil {
+		panic("unsupported date math: " + s)
+	}
+	return time.Now().UTC().Add(offset).Format(time.RFC3339)
+}
+
+// clauseList returns the clauses of a bool query occurrence, which may be a single clause or a list.
+func clauseList(value interface{}) []map[string]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{v}
+	case []interface{}:
+		var clauses []map[string]interface{}
+		for _, item := range v {
+			clauses = append(clauses, item.(map[string]interface{}))
+		}
+		return clauses
+	}
+	return nil
+}
+
+// lookupField returns the value of the dotted field in the document, or nil if it is missing.
+func lookupField(source map[string]interface{}, field string) interface{} {
+	var value interface{} = source
+	for _, name := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// compareValues compares two values numerically if both are numbers, and as strings otherwise.
+// Missing values are sorted last.
+func compareValues(a, b interface{}) int {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0
+		case a == nil:
+			return 1
+		default:
+			return -1
+		}
+	}
+	x, xErr := strconv.ParseFloat(fmt.Sprint(a), 64)
+	y, yErr := strconv.ParseFloat(fmt.Sprint(b), 64)
+	if xErr == nil && yErr == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
@@ -25,6 +25,12 @@ func (e *Elastic) ConnectCluster(ctx context.Context) error {
 	}
 	e.Logger.Info("Successfully fetched configuration from Vault", zap.String("project", e.Project))
 
+	// Add the encryption rules of the project to the global ones.
+	if err := e.compileEncryptRules(); err != nil {
+		e.Logger.Error("Invalid encryption rules", zap.String("project", e.Project), zap.Error(err))
+		return err
+	}
+
 	// If the scheme for any of the addresses is https://, then read the CA certificate.
 	for _, address := range e.Addresses {
 		parsedURL, err := url.Parse(address)
@@ -66,5 +72,8 @@ func (e *Elastic) ConnectCluster(ctx context.Context) error {
 	// Store the context for further use.
 	e.Ctx = ctx
 
+	// Make sure the indices get the proper mappings when they are created.
+	e.ensureTemplates()
+
 	return nil
 }
@@ -1,6 +1,7 @@
 package elasticop
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 	"strconv"
@@ -10,9 +11,11 @@ import (
 	"go.uber.org/zap"
 )
 
-// TraverseAndModify is a recursive function that traverses through the node's structure (which can be maps or slices).
+// TraverseAndModify traverses through the node's structure (which can be maps or slices).
 // Depending on the 'encrypt' flag, it either encrypts or decrypts the relevant fields.
 // Encryption is based on matching regex patterns. Decryption is based on value prefixes.
+// Encrypted values are stored in an envelope recording their JSON type, see cryptBatch.
+// The matching values are collected first, then encrypted or decrypted with Vault in batches.
 func (e *Elastic) TraverseAndModify(node interface{}, compiledRegex []*regexp.Regexp, encrypt bool, paths ...string) error {
 	var currentPath string
 	if len(paths) > 0 {
@@ -21,76 +24,294 @@ func (e *Elastic) TraverseAndModify(node interface{}, compiledRegex []*regexp.Re
 		currentPath = ""
 	}
 
+	batch := &cryptBatch{encrypt: encrypt}
+	if err := e.collectCryptJobs(node, compiledRegex, batch, currentPath); err != nil {
+		return err
+	}
+	return e.runCryptBatch(batch)
+}
+
+// collectCryptJobs is a recursive function that adds the values to encrypt or decrypt in the node to the batch.
+func (e *Elastic) collectCryptJobs(node interface{}, compiledRegex []*regexp.Regexp, batch *cryptBatch, currentPath string) error {
 	switch v := node.(type) {
 	case map[string]interface{}: // For JSON objects
 		for k, val := range v {
 			newPath := currentPath + "." + k
+			set := func(value interface{}) { v[k] = value }
 
-			if encrypt { // Encryption based on regex pattern matching
-				for _, re := range compiledRegex {
-					if re.MatchString(newPath) {
-						encryptedVal, err := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault).EncryptWithVault(fmt.Sprint(val), e.Project)
-						if err != nil {
-							e.Logger.Error("Failed to encrypt using vault", zap.String("path", newPath), zap.Error(err))
-							return err
-						}
-						v[k] = "tfb_" + encryptedVal
-						break
-					}
-				}
-			} else { // Decryption based on specific value prefix
-				strVal, isString := val.(string)
-				if isString && strings.HasPrefix(strVal, "tfb_vault:") {
-					decryptedVal, err := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault).DecryptWithVault(strings.TrimPrefix(strVal, "tfb_"), e.Project)
-					if err != nil {
-						e.Logger.Error("Failed to decrypt using vault", zap.String("path", newPath), zap.Error(err))
-						return err
-					}
-					v[k] = decryptedVal
-				}
+			queued, err := e.queueCryptJob(val, compiledRegex, batch, newPath, set)
+			if err != nil {
+				return err
 			}
 
-			// Continue traversal recursively to handle nested structures
-			if err := e.TraverseAndModify(val, compiledRegex, encrypt, newPath); err != nil {
-				return err
+			// Continue traversal recursively to handle nested structures, unless the whole value is encrypted
+			if !queued {
+				if err := e.collectCryptJobs(val, compiledRegex, batch, newPath); err != nil {
+					return err
+				}
 			}
 		}
 
 	case []interface{}: // For JSON arrays
 		for i, val := range v {
 			newPath := currentPath + "[" + strconv.Itoa(i) + "]"
+			set := func(value interface{}) { v[i] = value }
 
-			// Encryption and decryption logic similar to the map handling above
-			if encrypt {
-				for _, re := range compiledRegex {
-					if re.MatchString(newPath) {
-						encryptedVal, err := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault).EncryptWithVault(fmt.Sprint(val), e.Project)
-						if err != nil {
-							e.Logger.Error("Failed to encrypt array item using vault", zap.String("path", newPath), zap.Error(err))
-							return err
-						}
-						v[i] = "tfb_" + encryptedVal
-						break
-					}
-				}
-			} else {
-				strVal, isString := val.(string)
-				if isString && strings.HasPrefix(strVal, "tfb_vault:") {
-					decryptedVal, err := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault).DecryptWithVault(strings.TrimPrefix(strVal, "tfb_"), e.Project)
-					if err != nil {
-						e.Logger.Error("Failed to decrypt array item using vault", zap.String("path", newPath), zap.Error(err))
-						return err
-					}
-					v[i] = decryptedVal
+			// Queueing logic similar to the map handling above
+			queued, err := e.queueCryptJob(val, compiledRegex, batch, newPath, set)
+			if err != nil {
+				return err
+			}
+			if !queued {
+				if err := e.collectCryptJobs(val, compiledRegex, batch, newPath); err != nil {
+					return err
 				}
 			}
+		}
+	}
 
-			// Continue traversal recursively to handle nested structures
-			if err := e.TraverseAndModify(val, compiledRegex, encrypt, newPath); err != nil {
-				return err
+	return nil
+}
+
+// queueCryptJob adds the value to the batch if it must be encrypted or decrypted, and reports whether it was added.
+func (e *Elastic) queueCryptJob(val interface{}, compiledRegex []*regexp.Regexp, batch *cryptBatch, path string, set func(interface{})) (bool, error) {
+	strVal, isString := val.(string)
+
+	// Decryption based on specific value prefix
+	if !batch.encrypt {
+		if isString && isEncrypted(strVal) {
+			batch.addDecrypt(path, strVal, set, nil)
+			return true, nil
+		}
+		return false, nil
+	}
+
+	// Encryption based on regex pattern matching
+	if e.isExcluded(path) {
+		return false, nil
+	}
+	if isString && isEncrypted(strVal) {
+		// Values encrypted because Terraform flags them as sensitive are not encrypted again.
+		return false, nil
+	}
+	for _, re := range compiledRegex {
+		if re.MatchString(path) {
+			if err := batch.addEncrypt(path, val, set); err != nil {
+				e.Logger.Error("Failed to encode value to encrypt", zap.String("path", path), zap.Error(err))
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// compileEncryptRules compiles the include and exclude patterns of the project. The include patterns
+// are added to the global patterns, while the exclude patterns take precedence over both.
+func (e *Elastic) compileEncryptRules() error {
+	for _, pattern := range e.EncryptInclude {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid encrypt_include pattern %q: %s", pattern, err)
+		}
+		e.Encrypt = append(e.Encrypt, re)
+	}
+
+	e.encryptExclude = nil
+	for _, pattern := range e.EncryptExclude {
+		if strings.TrimSpace(pattern) == "" {
+			continue
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid encrypt_exclude pattern %q: %s", pattern, err)
+		}
+		e.encryptExclude = append(e.encryptExclude, re)
+	}
+	return nil
+}
+
+// isExcluded reports whether the path matches an exclude pattern of the project.
+func (e *Elastic) isExcluded(path string) bool {
+	for _, re := range e.encryptExclude {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prefixes of the encrypted values. Values are stored as "tfb_<type>:<ciphertext>", where the ciphertext is
+// the encrypted JSON encoding of the value. Values encrypted before the type was recorded are stored as
+// "tfb_vault:...", with the ciphertext of the value formatted as a string.
+const (
+	encryptedPrefix       = "tfb_"
+	legacyEncryptedPrefix = "tfb_vault:"
+)
+
+// encryptedTypes lists the JSON types recorded in the envelope of encrypted values.
+var encryptedTypes = []string{"string", "number", "bool", "array", "object", "null"}
+
+// jsonType returns the JSON type of a decoded JSON value.
+func jsonType(val interface{}) string {
+	switch val.(type) {
+	case string:
+		return "string"
+	case float64, json.Number:
+		return "number"
+	case bool:
+		return "bool"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	case nil:
+		return "null"
+	default:
+		return "string"
+	}
+}
+
+// isEncrypted reports whether the string is an encrypted value, in the current or the legacy envelope.
+func isEncrypted(s string) bool {
+	if strings.HasPrefix(s, legacyEncryptedPrefix) {
+		return true
+	}
+	for _, typ := range encryptedTypes {
+		if strings.HasPrefix(s, encryptedPrefix+typ+":vault:") {
+			return true
+		}
+	}
+	return false
+}
+
+// cryptJob is a value to encrypt or decrypt in a batch.
+type cryptJob struct {
+	path string
+
+	// input is the JSON encoding of the value to encrypt, or the ciphertext to decrypt.
+	input string
+
+	// typ is the JSON type of the value, and legacy is set for values in the legacy envelope.
+	typ    string
+	legacy bool
+
+	// set stores the result in place of the value.
+	set func(interface{})
+
+	// fail handles the failure of the value. If it is nil, the failure fails the whole batch.
+	fail func(error)
+}
+
+// cryptBatch collects the values to encrypt or decrypt, so they are sent to Vault in batches.
+// Values are encrypted as their JSON encoding, and stored in an envelope recording their JSON type,
+// so decryption restores the original value.
+type cryptBatch struct {
+	encrypt bool
+	jobs    []cryptJob
+}
+
+// addEncrypt adds a value to encrypt to the batch.
+func (b *cryptBatch) addEncrypt(path string, val interface{}, set func(interface{})) error {
+	encoded, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %s", err)
+	}
+	b.jobs = append(b.jobs, cryptJob{path: path, input: string(encoded), typ: jsonType(val), set: set})
+	return nil
+}
+
+// addDecrypt adds an encrypted value to decrypt to the batch.
+func (b *cryptBatch) addDecrypt(path, s string, set func(interface{}), fail func(error)) {
+	job := cryptJob{path: path, set: set, fail: fail}
+
+	if strings.HasPrefix(s, legacyEncryptedPrefix) {
+		// Values encrypted before the type was recorded are strings.
+		job.input = strings.TrimPrefix(s, encryptedPrefix)
+		job.legacy = true
+	} else {
+		job.typ, job.input, _ = strings.Cut(strings.TrimPrefix(s, encryptedPrefix), ":")
+	}
+	b.jobs = append(b.jobs, job)
+}
+
+// runCryptBatch encrypts or decrypts the values of the batch with Vault and stores the results in place.
+// The results are only stored once every value succeeded, or failed with a fail handler, so a failed batch
+// leaves all values as they were rather than some of them encrypted or decrypted.
+func (e *Elastic) runCryptBatch(batch *cryptBatch) error {
+	if len(batch.jobs) == 0 {
+		return nil
+	}
+	vault := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault)
+
+	inputs := make([]string, len(batch.jobs))
+	for i, job := range batch.jobs {
+		inputs[i] = job.input
+	}
+
+	var results []vaultop.BatchResult
+	var err error
+	if batch.encrypt {
+		results, err = vault.EncryptBatchWithVault(inputs, e.Project)
+	} else {
+		results, err = vault.DecryptBatchWithVault(inputs, e.Project)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Determine the result of every value before changing any of them.
+	values := make([]interface{}, len(batch.jobs))
+	errs := make([]error, len(batch.jobs))
+	for i, job := range batch.jobs {
+		err := results[i].Err
+		if err == nil {
+			switch {
+			case batch.encrypt:
+				values[i] = encryptedPrefix + job.typ + ":" + results[i].Value
+			case job.legacy:
+				values[i] = results[i].Value
+			default:
+				values[i], err = decodeDecrypted(results[i].Value, job.typ)
 			}
 		}
+		errs[i] = err
+
+		if err != nil && job.fail == nil {
+			if batch.encrypt {
+				e.Logger.Error("Failed to encrypt using vault", zap.String("path", job.path), zap.Error(err))
+			} else {
+				e.Logger.Error("Failed to decrypt using vault", zap.String("path", job.path), zap.Error(err))
+			}
+			return err
+		}
+	}
+
+	for i, job := range batch.jobs {
+		if errs[i] != nil {
+			job.fail(errs[i])
+			continue
+		}
+		job.set(values[i])
 	}
 
 	return nil
 }
+
+// decodeDecrypted restores a decrypted value in the current envelope to its original JSON value,
+// keeping numbers as they were encoded.
+func decodeDecrypted(decryptedVal, typ string) (interface{}, error) {
+	var val interface{}
+	decoder := json.NewDecoder(strings.NewReader(decryptedVal))
+	decoder.UseNumber()
+	if err := decoder.Decode(&val); err != nil {
+		return nil, fmt.Errorf("failed to decode decrypted value: %s", err)
+	}
+	if jsonType(val) != typ {
+		return nil, fmt.Errorf("decrypted value is a %s instead of a %s", jsonType(val), typ)
+	}
+	return val, nil
+}
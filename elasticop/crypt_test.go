@@ -0,0 +1,145 @@
+package elasticop
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+)
+
+// newCryptTestElastic returns a client encrypting the password fields with the fake Transit backend,
+// which receives the values in small chunks.
+func newCryptTestElastic(t *testing.T) (*Elastic, *fakeCluster, *fakeTransit) {
+	t.Helper()
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	e.Encrypt = []*regexp.Regexp{regexp.MustCompile(`password$`)}
+	transit := withFakeTransit(t, e)
+	e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault).TransitBatchSize = 2
+	return e, cluster, transit
+}
+
+// passwords returns a node with the given number of password fields.
+func passwords(count int) map[string]interface{} {
+	node := map[string]interface{}{}
+	for i := 0; i < count; i++ {
+		node["user"+strconv.Itoa(i)] = map[string]interface{}{"password": "secret-" + strconv.Itoa(i)}
+	}
+	return node
+}
+
+func TestTraverseAndModifyFailedChunkChangesNothing(t *testing.T) {
+	e, _, transit := newCryptTestElastic(t)
+
+	// One value in one of the chunks fails to encrypt, so no value may be left encrypted.
+	node := passwords(9)
+	transit.fail(`"secret-7"`)
+	if err := e.TraverseAndModify(node, e.Encrypt, true); err == nil {
+		t.Fatal("expected the encryption to fail")
+	}
+	if transit.requests < 2 {
+		t.Fatalf("expected the values to be sent in several chunks, got %d requests", transit.requests)
+	}
+	for user, fields := range node {
+		expected := "secret-" + user[len("user"):]
+		if password := fields.(map[string]interface{})["password"]; password != expected {
+			t.Fatalf("expected %s to be left as %s, got %v", user, expected, password)
+		}
+	}
+
+	// The same applies to decryption.
+	transit.mu.Lock()
+	transit.failing = map[string]bool{}
+	transit.mu.Unlock()
+	if err := e.TraverseAndModify(node, e.Encrypt, true); err != nil {
+		t.Fatalf("TraverseAndModify failed: %s", err)
+	}
+	encrypted := map[string]string{}
+	for user, fields := range node {
+		encrypted[user] = fields.(map[string]interface{})["password"].(string)
+	}
+	transit.fail(`"secret-2"`)
+	if err := e.TraverseAndModify(node, nil, false); err == nil {
+		t.Fatal("expected the decryption to fail")
+	}
+	for user, fields := range node {
+		if password := fields.(map[string]interface{})["password"]; password != encrypted[user] {
+			t.Fatalf("expected %s to be left encrypted, got %v", user, password)
+		}
+	}
+}
+
+func TestRunCryptBatchFailHandler(t *testing.T) {
+	e, _, transit := newCryptTestElastic(t)
+
+	// Values with a fail handler don't fail the batch, the other values are still decrypted.
+	values := []interface{}{
+		"tfb_string:" + fakeCiphertext(`"first"`),
+		"tfb_string:" + fakeCiphertext(`"broken"`),
+		"tfb_number:" + fakeCiphertext("3"),
+	}
+	transit.fail(`"broken"`)
+
+	var failed []error
+	batch := &cryptBatch{}
+	for i := range values {
+		i := i
+		batch.addDecrypt("", values[i].(string), func(value interface{}) { values[i] = value }, func(err error) { failed = append(failed, err) })
+	}
+	if err := e.runCryptBatch(batch); err != nil {
+		t.Fatalf("runCryptBatch failed: %s", err)
+	}
+	if len(failed) != 1 || values[0] != "first" || values[1] != "tfb_string:"+fakeCiphertext(`"broken"`) || values[2] == nil {
+		t.Fatalf("unexpected values %v, failures %v", values, failed)
+	}
+}
+
+func TestStoreStateFailsOnEncryptionError(t *testing.T) {
+	e, cluster, transit := newCryptTestElastic(t)
+
+	transit.fail(`"secret-4"`)
+	state := `{"version": 4, "lineage": "lineage", "serial": 1, "outputs": {}, "resources": [` +
+		`{"mode": "managed", "type": "db", "name": "main", "instances": [{"attributes": ` +
+		`{"password": "secret-1", "users": [{"password": "secret-2"}, {"password": "secret-3"}, {"password": "secret-4"}]}}]}]}`
+
+	httpStatus, err := e.StoreState([]byte(state), false)
+	if err == nil || httpStatus != http.StatusInternalServerError {
+		t.Fatalf("expected the write to fail, got %d (%v)", httpStatus, err)
+	}
+	for _, index := range []string{"terraform-state", "terraform-resources", "terraform-state-pointers"} {
+		if docs := cluster.documents(index); len(docs) != 0 {
+			t.Fatalf("expected nothing to be written to %s, got %d documents", index, len(docs))
+		}
+	}
+}
+
+func TestRenderStateFailsOnDecryptionError(t *testing.T) {
+	e, _, transit := newCryptTestElastic(t)
+
+	// A state stored without the raw state is reconstructed and decrypted.
+	newSource := func() map[string]interface{} {
+		return map[string]interface{}{
+			"version": 4, "lineage": "lineage", "serial": 1, "generation": "current",
+			"outputs": map[string]interface{}{
+				"first":  map[string]interface{}{"value": "tfb_string:" + fakeCiphertext(`"secret-1"`)},
+				"second": map[string]interface{}{"value": "tfb_string:" + fakeCiphertext(`"secret-2"`)},
+			},
+		}
+	}
+	body, err := e.renderState(newSource())
+	if err != nil {
+		t.Fatalf("renderState failed: %s", err)
+	}
+	if !strings.Contains(string(body), `"secret-1"`) || !strings.Contains(string(body), `"secret-2"`) {
+		t.Fatalf("expected the outputs to be decrypted, got %s", body)
+	}
+
+	// A value which can't be decrypted fails the request rather than being served encrypted.
+	transit.fail(`"secret-2"`)
+	if body, err := e.renderState(newSource()); err == nil {
+		t.Fatalf("expected the state not to be rendered, got %s", body)
+	}
+}
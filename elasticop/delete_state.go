@@ -0,0 +1,56 @@
+package elasticop
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DeleteState marks the state as deleted by committing a tombstone as its latest version.
+// Previous versions of the state and their resources are kept in Elasticsearch,
+// but GetState no longer returns them.
+func (e *Elastic) DeleteState() (int, error) {
+	// Get the current timestamp in UTC format.
+	currentTime := time.Now().UTC().Format(time.RFC3339)
+
+	// Generate the ID of the tombstone version.
+	generation, err := newGenerationID()
+	if err != nil {
+		e.Logger.Error("Failed to generate generation ID", zap.Error(err))
+		return http.StatusInternalServerError, err
+	}
+
+	// Read the current version, which the tombstone replaces.
+	_, pointer, err := e.currentState()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Make sure the backend fields are mapped before the tombstone is stored.
+	if err := e.ensureIndex(e.StateIndex, stateDocumentMappings); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	tombstone := map[string]interface{}{
+		"timestamp": currentTime,
+		"author":    e.Author,
+		"deleted":   true,
+	}
+
+	// Save the tombstone to Elasticsearch and commit it.
+	if err := e.writeStateDocument(generation, pointer, tombstone); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error deleting state: %s", err)
+	}
+	if err := e.commitGeneration(pointer, tombstone); err != nil {
+		if errors.Is(err, ErrStateChanged) {
+			return http.StatusConflict, err
+		}
+		return http.StatusInternalServerError, fmt.Errorf("error deleting state: %s", err)
+	}
+
+	e.Logger.Info("Successfully deleted state", zap.String("timestamp", currentTime), zap.String("project", e.Project))
+	return http.StatusOK, nil
+}
@@ -0,0 +1,284 @@
+package elasticop
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// maskedValue replaces the values in a diff which are encrypted and couldn't be decrypted by the caller.
+const maskedValue = "(sensitive value)"
+
+// StateDiff describes the differences between the resources of two versions of the state.
+type StateDiff struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Added   []ResourceKey     `json:"added"`
+	Removed []ResourceKey     `json:"removed"`
+	Changed []ResourceChanges `json:"changed"`
+}
+
+// ResourceKey identifies a resource instance in the state.
+type ResourceKey struct {
+	Address  string      `json:"address"`
+	Module   string      `json:"module,omitempty"`
+	Mode     string      `json:"mode"`
+	Type     string      `json:"type"`
+	Name     string      `json:"name"`
+	IndexKey interface{} `json:"index_key,omitempty"`
+}
+
+// ResourceChanges lists the attributes of a resource instance which changed between the versions.
+type ResourceChanges struct {
+	ResourceKey
+	Attributes []AttributeChange `json:"attributes"`
+}
+
+// AttributeChange describes the change of a single attribute, identified by its path within the attributes.
+// Encrypted values which the caller can't decrypt are masked, and the change is marked as sensitive.
+// If both values are masked, their ciphertexts differ even if the value stayed the same, since every write
+// encrypts values anew, so the change is marked as unknown.
+type AttributeChange struct {
+	Path      string      `json:"path"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+	Sensitive bool        `json:"sensitive,omitempty"`
+	Unknown   bool        `json:"unknown,omitempty"`
+}
+
+// diffValue is a leaf value of the attributes of a resource instance.
+type diffValue struct {
+	value interface{}
+
+	// masked is set for encrypted values that couldn't be decrypted, which are compared by their ciphertext.
+	masked bool
+}
+
+// maskedCiphertext replaces an encrypted value in the attributes which couldn't be decrypted by the caller.
+type maskedCiphertext string
+
+// resourceInstance is a resource instance with its flattened attributes.
+type resourceInstance struct {
+	key        ResourceKey
+	attributes map[string]diffValue
+}
+
+// DiffVersions compares the resources of two committed versions of the state.
+// Resource instances are matched by their module, mode, type, name and index key, and the changed ones
+// are reported with the attributes that changed. Encrypted values are decrypted with the Vault client
+// of the caller, and masked if the caller can't decrypt them.
+func (e *Elastic) DiffVersions(from, to string) (*StateDiff, int, error) {
+	fromInstances, httpStatus, err := e.versionInstances(from)
+	if err != nil {
+		return nil, httpStatus, err
+	}
+	toInstances, httpStatus, err := e.versionInstances(to)
+	if err != nil {
+		return nil, httpStatus, err
+	}
+
+	diff := &StateDiff{
+		From:    from,
+		To:      to,
+		Added:   []ResourceKey{},
+		Removed: []ResourceKey{},
+		Changed: []ResourceChanges{},
+	}
+
+	// Collect the removed and changed instances.
+	for address, before := range fromInstances {
+		after, ok := toInstances[address]
+		if !ok {
+			diff.Removed = append(diff.Removed, before.key)
+			continue
+		}
+		if changes := diffAttributes(before.attributes, after.attributes); len(changes) > 0 {
+			diff.Changed = append(diff.Changed, ResourceChanges{ResourceKey: after.key, Attributes: changes})
+		}
+	}
+
+	// Collect the added instances.
+	for address, after := range toInstances {
+		if _, ok := fromInstances[address]; !ok {
+			diff.Added = append(diff.Added, after.key)
+		}
+	}
+
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].Address < diff.Added[j].Address })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].Address < diff.Removed[j].Address })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Address < diff.Changed[j].Address })
+
+	e.Logger.Info("Successfully compared state versions", zap.String("project", e.Project), zap.String("from", from), zap.String("to", to))
+	return diff, http.StatusOK, nil
+}
+
+// versionInstances retrieves the resource instances of a committed version, keyed by their address.
+func (e *Elastic) versionInstances(id string) (map[string]resourceInstance, int, error) {
+	source, httpStatus, err := e.getVersionDocument(id)
+	if err != nil {
+		return nil, httpStatus, err
+	}
+
+	// Get the resources connected to the state
+	timestamp, _ := source["timestamp"].(string)
+	generation, _ := source["generation"].(string)
+	resources, err := e.GetResources(generation, timestamp)
+	if err != nil {
+		e.Logger.Error("Error fetching the resources from Elasticsearch", zap.Error(err))
+		return nil, http.StatusInternalServerError, fmt.Errorf("error fetching resources: %s", err)
+	}
+
+	// Decrypt the encrypted values of the attributes in a batch, masking those the caller can't decrypt.
+	batch := &cryptBatch{}
+	for _, resource := range resources {
+		queueDecryptAttributes(batch, resource["instances"], "")
+	}
+	if err := e.runCryptBatch(batch); err != nil {
+		e.Logger.Error("Failed to decrypt the resources", zap.Error(err))
+		return nil, http.StatusInternalServerError, fmt.Errorf("error decrypting resources: %s", err)
+	}
+
+	instances := map[string]resourceInstance{}
+	for _, resource := range resources {
+		key := ResourceKey{}
+		key.Module, _ = resource["module"].(string)
+		key.Mode, _ = resource["mode"].(string)
+		key.Type, _ = resource["type"].(string)
+		key.Name, _ = resource["name"].(string)
+
+		instanceList, _ := resource["instances"].([]interface{})
+		for _, item := range instanceList {
+			instance, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			instanceKey := key
+			instanceKey.IndexKey = instance["index_key"]
+			instanceKey.Address = resourceAddress(instanceKey)
+
+			attributes := map[string]diffValue{}
+			flattenAttributes(instance["attributes"], "", attributes)
+			instances[instanceKey.Address] = resourceInstance{key: instanceKey, attributes: attributes}
+		}
+	}
+	return instances, http.StatusOK, nil
+}
+
+// resourceAddress returns the Terraform address of the resource instance, like module.app.aws_instance.web["a"].
+func resourceAddress(key ResourceKey) string {
+	var address strings.Builder
+	if key.Module != "" {
+		address.WriteString(key.Module + ".")
+	}
+	if key.Mode == "data" {
+		address.WriteString("data.")
+	}
+	address.WriteString(key.Type + "." + key.Name)
+
+	switch index := key.IndexKey.(type) {
+	case string:
+		address.WriteString("[" + strconv.Quote(index) + "]")
+	case json.Number:
+		address.WriteString("[" + index.String() + "]")
+	case nil:
+	default:
+		address.WriteString(fmt.Sprintf("[%v]", index))
+	}
+	return address.String()
+}
+
+// queueDecryptAttributes adds the encrypted values in the node to the batch. Values which can't be decrypted
+// are replaced by their masked ciphertext.
+func queueDecryptAttributes(batch *cryptBatch, node interface{}, path string) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if str, ok := val.(string); ok && isEncrypted(str) {
+				batch.addDecrypt(path+"."+k, str, func(value interface{}) { v[k] = value }, func(err error) { v[k] = maskedCiphertext(str) })
+				continue
+			}
+			queueDecryptAttributes(batch, val, path+"."+k)
+		}
+	case []interface{}:
+		for i, val := range v {
+			if str, ok := val.(string); ok && isEncrypted(str) {
+				batch.addDecrypt(path+"["+strconv.Itoa(i)+"]", str, func(value interface{}) { v[i] = value }, func(err error) { v[i] = maskedCiphertext(str) })
+				continue
+			}
+			queueDecryptAttributes(batch, val, path+"["+strconv.Itoa(i)+"]")
+		}
+	}
+}
+
+// flattenAttributes collects the leaf values of the decrypted attributes, keyed by their path.
+// Encrypted lists and objects are compared by their leaf values, and masked values by their ciphertext,
+// which only tells that they are the same, not that they changed.
+func flattenAttributes(node interface{}, path string, values map[string]diffValue) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			childPath := k
+			if path != "" {
+				childPath = path + "." + k
+			}
+			flattenAttributes(val, childPath, values)
+		}
+	case []interface{}:
+		for i, val := range v {
+			flattenAttributes(val, path+"["+strconv.Itoa(i)+"]", values)
+		}
+	case maskedCiphertext:
+		values[path] = diffValue{value: string(v), masked: true}
+	default:
+		values[path] = diffValue{value: v}
+	}
+}
+
+// diffAttributes compares the flattened attributes of two versions of a resource instance.
+func diffAttributes(before, after map[string]diffValue) []AttributeChange {
+	paths := map[string]bool{}
+	for path := range before {
+		paths[path] = true
+	}
+	for path := range after {
+		paths[path] = true
+	}
+
+	var changes []AttributeChange
+	for path := range paths {
+		oldValue, hadValue := before[path]
+		newValue, hasValue := after[path]
+		if hadValue && hasValue && oldValue.masked == newValue.masked && reflect.DeepEqual(oldValue.value, newValue.value) {
+			continue
+		}
+
+		// Masked values can only be told to be the same by their ciphertext, so a different ciphertext
+		// doesn't mean that the value changed.
+		change := AttributeChange{Path: path, Unknown: hadValue && hasValue && oldValue.masked && newValue.masked}
+		if hadValue {
+			change.Before = oldValue.value
+			if oldValue.masked {
+				change.Before = maskedValue
+				change.Sensitive = true
+			}
+		}
+		if hasValue {
+			change.After = newValue.value
+			if newValue.masked {
+				change.After = maskedValue
+				change.Sensitive = true
+			}
+		}
+		changes = append(changes, change)
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
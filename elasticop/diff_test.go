@@ -0,0 +1,83 @@
+package elasticop
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// rotatedCiphertext returns a ciphertext of the plaintext by the fake Transit backend, encrypted with
+// another key version, which differs from the ciphertext of the same plaintext by the current key version.
+func rotatedCiphertext(plaintext string) string {
+	return "vault:v2:" + base64.StdEncoding.EncodeToString([]byte(plaintext))
+}
+
+// putVersion stores a committed version of the state with a single resource instance with the attributes.
+func putVersion(cluster *fakeCluster, id, timestamp string, attributes map[string]interface{}) {
+	cluster.put("terraform-state", id, map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "generation": id, "committed": true, "timestamp": timestamp,
+	})
+	cluster.put("terraform-resources", "", map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "generation": id, "position": 0,
+		"mode": "managed", "type": "db", "name": "main",
+		"instances": []interface{}{map[string]interface{}{"attributes": attributes}},
+	})
+}
+
+func TestDiffVersionsMaskedValues(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	transit := withFakeTransit(t, e)
+
+	// Both versions hold the same passwords, encrypted anew by each write, and a password which changed.
+	putVersion(cluster, "first", "2024-01-01T00:00:00Z", map[string]interface{}{
+		"password":  "tfb_string:" + fakeCiphertext(`"secret"`),
+		"changed":   "tfb_string:" + fakeCiphertext(`"before"`),
+		"copied":    "tfb_string:" + fakeCiphertext(`"copied"`),
+		"encrypted": "plain",
+	})
+	putVersion(cluster, "second", "2024-01-02T00:00:00Z", map[string]interface{}{
+		"password":  "tfb_string:" + rotatedCiphertext(`"secret"`),
+		"changed":   "tfb_string:" + rotatedCiphertext(`"after"`),
+		"copied":    "tfb_string:" + fakeCiphertext(`"copied"`),
+		"encrypted": "tfb_string:" + fakeCiphertext(`"plain"`),
+	})
+
+	// A caller who can decrypt the values only sees the change of the values.
+	diff, _, err := e.DiffVersions("first", "second")
+	if err != nil {
+		t.Fatalf("DiffVersions failed: %s", err)
+	}
+	if len(diff.Changed) != 1 || len(diff.Changed[0].Attributes) != 1 {
+		t.Fatalf("expected a single changed attribute, got %+v", diff.Changed)
+	}
+	if change := diff.Changed[0].Attributes[0]; change.Path != "changed" || change.Before != "before" || change.After != "after" || change.Sensitive || change.Unknown {
+		t.Fatalf("unexpected change %+v", change)
+	}
+
+	// A caller who can't decrypt them can't tell whether the values changed, unless the ciphertext is the same.
+	for _, plaintext := range []string{`"secret"`, `"before"`, `"after"`, `"copied"`, `"plain"`} {
+		transit.fail(plaintext)
+	}
+	diff, _, err = e.DiffVersions("first", "second")
+	if err != nil {
+		t.Fatalf("DiffVersions failed: %s", err)
+	}
+	if len(diff.Changed) != 1 {
+		t.Fatalf("expected a changed instance, got %+v", diff.Changed)
+	}
+	changes := map[string]AttributeChange{}
+	for _, change := range diff.Changed[0].Attributes {
+		changes[change.Path] = change
+	}
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, got %+v", diff.Changed[0].Attributes)
+	}
+	for _, path := range []string{"password", "changed"} {
+		if change := changes[path]; !change.Sensitive || !change.Unknown || change.Before != maskedValue || change.After != maskedValue {
+			t.Errorf("expected the change of %s to be sensitive and unknown, got %+v", path, change)
+		}
+	}
+	if change := changes["encrypted"]; !change.Sensitive || change.Unknown || change.Before != "plain" || change.After != maskedValue {
+		t.Errorf("expected the newly encrypted value to be a known sensitive change, got %+v", change)
+	}
+}
@@ -3,91 +3,487 @@ package elasticop
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"go.uber.org/zap"
 )
 
-// Define the index in Elasticsearch where the locks will be stored.
-const lockIndex = "terraform-locks"
+// lockMappings defines the mappings of the index where the locks are stored.
+var lockMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"project":   map[string]interface{}{"type": "keyword"},
+		"workspace": map[string]interface{}{"type": "keyword"},
+		"lockedBy":  map[string]interface{}{"type": "keyword"},
+		"version":   map[string]interface{}{"type": "long"},
+		"created":   map[string]interface{}{"type": "date"},
+		"expires":   map[string]interface{}{"type": "date"},
+		"evicted":   map[string]interface{}{"type": "object", "enabled": false},
+		"info": map[string]interface{}{
+			"properties": map[string]interface{}{
+				"ID":        map[string]interface{}{"type": "keyword"},
+				"Operation": map[string]interface{}{"type": "keyword"},
+				"Info":      map[string]interface{}{"type": "text"},
+				"Who":       map[string]interface{}{"type": "keyword"},
+				"Version":   map[string]interface{}{"type": "keyword"},
+				"Created":   map[string]interface{}{"type": "date"},
+				"Path":      map[string]interface{}{"type": "keyword"},
+			},
+		},
+	},
+}
+
+// lockPageSize is the number of locks fetched per page by ListLocks.
+const lockPageSize = 1000
+
+// ErrLockChanged is returned when a lock was modified or replaced between reading and releasing it.
+var ErrLockChanged = errors.New("lock was changed concurrently")
+
+// ErrLockNotHeld is returned when renewing a lock which doesn't exist or is held by another client.
+var ErrLockNotHeld = errors.New("lock is not held by the caller")
+
+// LockInfo mirrors the lock information Terraform sends in the body of LOCK and UNLOCK requests.
+type LockInfo struct {
+	ID        string    `json:"ID"`
+	Operation string    `json:"Operation"`
+	Info      string    `json:"Info"`
+	Who       string    `json:"Who"`
+	Version   string    `json:"Version"`
+	Created   time.Time `json:"Created"`
+	Path      string    `json:"Path"`
+}
 
 // ESDistributedLock represents the structure of a lock stored in Elasticsearch.
 type ESDistributedLock struct {
-	Project  string `json:"project"`
-	LockedBy string `json:"lockedBy"`
-	Version  int64  `json:"version"`
+	Project   string    `json:"project"`
+	Workspace string    `json:"workspace"`
+	LockedBy  string    `json:"lockedBy"`
+	Version   int64     `json:"version"`
+	Created   time.Time `json:"created"`
+	Info      LockInfo  `json:"info"`
+
+	// Expires is the end of the lease, after which the lock can be taken over. Nil means no expiry.
+	Expires *time.Time `json:"expires,omitempty"`
+
+	// Evicted is the lock info of the previous holder, if the lock was taken over after its lease expired.
+	Evicted *LockInfo `json:"evicted,omitempty"`
+
+	// SeqNo and PrimaryTerm identify the revision of the lock document that was read,
+	// and are used to guard the release of the lock against concurrent changes.
+	SeqNo       int `json:"-"`
+	PrimaryTerm int `json:"-"`
 }
 
-// AcquireLock attempts to create a lock for the specified project.
-// If the lock already exists, it returns false, otherwise it returns true.
-func (e *Elastic) AcquireLock(project, remoteId string) (bool, error) {
-	var buf bytes.Buffer
-	lock := ESDistributedLock{
-		Project:  project,
-		LockedBy: remoteId,
+// Expired reports whether the lease of the lock has ended.
+func (l *ESDistributedLock) Expired() bool {
+	return l.Expires != nil && time.Now().After(*l.Expires)
+}
+
+// leaseExpiry returns the end of a lease starting now, or nil if the project has no lease length configured.
+func (e *Elastic) leaseExpiry() *time.Time {
+	if e.LockTTL <= 0 {
+		return nil
+	}
+	expires := time.Now().UTC().Add(e.LockTTL)
+	return &expires
+}
+
+// lockAcquireAttempts is the number of times the lock is created again when the conflicting lock is gone
+// by the time it is read.
+const lockAcquireAttempts = 5
+
+// AcquireLock attempts to create a lock for the project and workspace.
+// The lock document is created exclusively, so only one of several concurrent callers can succeed.
+// If the lock already exists, it returns false together with the current holder, otherwise it returns true.
+// If the conflicting lock was released before it could be read, the creation is retried, so the returned
+// holder is only nil if the lock kept changing on every attempt.
+// A lock whose lease has expired is taken over, and its holder is recorded in the new lock as evicted.
+func (e *Elastic) AcquireLock(remoteId string, info LockInfo) (bool, *ESDistributedLock, error) {
+	// Make sure the lock index exists with the proper mappings.
+	if err := e.ensureIndex(e.LockIndex, lockMappings); err != nil {
+		return false, nil, err
 	}
 
+	for attempt := 1; ; attempt++ {
+		lock := ESDistributedLock{
+			Project:   e.Project,
+			Workspace: e.Workspace,
+			LockedBy:  remoteId,
+			Created:   time.Now().UTC(),
+			Info:      info,
+			Expires:   e.leaseExpiry(),
+		}
+
+		created, err := e.createLock(lock)
+		if err != nil {
+			return false, nil, err
+		}
+		if created {
+			e.Logger.Info("Lock successfully acquired", zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.String("lock_id", info.ID))
+			e.RecordLockEvent(LockEventAcquire, "acquired", &lock, nil)
+			return true, nil, nil
+		}
+
+		// The lock already exists, report the current holder.
+		e.Logger.Info("Lock already exists", zap.String("project", e.Project), zap.String("workspace", e.Workspace))
+		holder, err := e.GetLock()
+		if err != nil {
+			return false, nil, err
+		}
+		if holder != nil && holder.Expired() {
+			acquired, current, err := e.takeOverLock(lock, holder)
+			if err != nil || acquired || current != nil || attempt >= lockAcquireAttempts {
+				return acquired, current, err
+			}
+			continue
+		}
+		if holder != nil || attempt >= lockAcquireAttempts {
+			return false, holder, nil
+		}
+
+		// The conflicting lock was released in the meantime, so the lock is free again.
+		e.Logger.Info("Conflicting lock was released, retrying", zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.Int("attempt", attempt))
+	}
+}
+
+// createLock creates the lock document, failing if it already exists.
+// It returns false without an error if the lock already exists.
+func (e *Elastic) createLock(lock ESDistributedLock) (bool, error) {
+	var buf bytes.Buffer
+
 	// Convert the lock into JSON format.
 	if err := json.NewEncoder(&buf).Encode(lock); err != nil {
 		e.Logger.Error("Error encoding lock data", zap.Error(err))
 		return false, err
 	}
 
-	// Attempt to create the lock in Elasticsearch.
-	res, err := e.Client.Index(
-		lockIndex,
+	// Attempt to create the lock in Elasticsearch, failing if the document already exists.
+	res, err := e.Client.Create(
+		e.LockIndex,
+		e.scopeDocumentID(),
 		&buf,
-		e.Client.Index.WithDocumentID(project),
-		e.Client.Index.WithRefresh("true"),
+		e.Client.Create.WithContext(e.Ctx),
+		e.Client.Create.WithRefresh("true"),
 	)
-	defer res.Body.Close()
-
 	if err != nil {
-		// Check if the error is because the lock already exists.
-		if res.StatusCode == http.StatusConflict {
-			e.Logger.Info("Lock already exists", zap.String("project", project))
-			return false, nil
-		}
 		e.Logger.Error("Error creating the lock in Elasticsearch", zap.Error(err))
 		return false, err
 	}
+	defer res.Body.Close()
 
-	// If the lock was successfully created, return true.
-	if res.StatusCode == http.StatusCreated {
-		e.Logger.Info("Lock successfully acquired", zap.String("project", project))
+	switch res.StatusCode {
+	case http.StatusCreated:
 		return true, nil
+	case http.StatusConflict:
+		return false, nil
 	}
 
 	e.Logger.Warn("Failed to acquire lock, unknown reason", zap.Int("status_code", res.StatusCode))
-	return false, nil
+	return false, fmt.Errorf("unexpected status code: %d", res.StatusCode)
 }
 
-// ReleaseLock attempts to release a lock for the specified project.
-// Returns true if the lock was successfully released or if the lock didn't exist, false otherwise.
-func (e *Elastic) ReleaseLock(project string) (bool, error) {
-	// Attempt to delete the lock in Elasticsearch.
-	res, err := e.Client.Delete(
-		lockIndex,
-		project,
-		e.Client.Delete.WithRefresh("true"),
+// takeOverLock replaces the expired lock of the holder with the given lock.
+// The replacement only succeeds if the expired lock hasn't changed since it was read.
+func (e *Elastic) takeOverLock(lock ESDistributedLock, holder *ESDistributedLock) (bool, *ESDistributedLock, error) {
+	var buf bytes.Buffer
+	lock.Evicted = &holder.Info
+
+	// Convert the lock into JSON format.
+	if err := json.NewEncoder(&buf).Encode(lock); err != nil {
+		e.Logger.Error("Error encoding lock data", zap.Error(err))
+		return false, nil, err
+	}
+
+	// Replace the expired lock, guarded by the revision that was read.
+	res, err := e.Client.Index(
+		e.LockIndex,
+		&buf,
+		e.Client.Index.WithContext(e.Ctx),
+		e.Client.Index.WithDocumentID(e.scopeDocumentID()),
+		e.Client.Index.WithIfSeqNo(holder.SeqNo),
+		e.Client.Index.WithIfPrimaryTerm(holder.PrimaryTerm),
+		e.Client.Index.WithRefresh("true"),
+	)
+	if err != nil {
+		e.Logger.Error("Error taking over the lock in Elasticsearch", zap.Error(err))
+		return false, nil, err
+	}
+	defer res.Body.Close()
+
+	// Another client renewed or took over the lock in the meantime.
+	if res.StatusCode == http.StatusConflict {
+		e.Logger.Info("Expired lock was changed before it could be taken over", zap.String("project", e.Project), zap.String("workspace", e.Workspace))
+		current, err := e.GetLock()
+		if err != nil {
+			return false, nil, err
+		}
+		return false, current, nil
+	}
+
+	if res.IsError() {
+		e.Logger.Warn("Failed to take over lock, unknown reason", zap.Int("status_code", res.StatusCode))
+		return false, nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	e.Logger.Warn("Expired lock taken over",
+		zap.String("project", e.Project),
+		zap.String("workspace", e.Workspace),
+		zap.String("lock_id", lock.Info.ID),
+		zap.String("evicted_id", holder.Info.ID),
+		zap.String("evicted_who", holder.Info.Who),
+		zap.Timep("expired", holder.Expires))
+	e.RecordLockEvent(LockEventEvict, "expired", holder, &lock.Info)
+	e.RecordLockEvent(LockEventAcquire, "taken-over", &lock, nil)
+	return true, nil, nil
+}
+
+// RenewLock extends the lease of the lock held by the caller identified by the lock ID.
+// It returns ErrLockNotHeld if the lock doesn't exist or is held by another client.
+func (e *Elastic) RenewLock(id string) (*ESDistributedLock, error) {
+	lock, err := e.GetLock()
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil || lock.Info.ID != id {
+		return nil, ErrLockNotHeld
+	}
+	return e.ExtendLease(lock)
+}
+
+// ExtendLease extends the lease of the lock from now on, provided the lock wasn't changed since it was read.
+// It returns ErrLockChanged if the lock was changed or released in the meantime.
+func (e *Elastic) ExtendLease(lock *ESDistributedLock) (*ESDistributedLock, error) {
+	var buf bytes.Buffer
+
+	// Extend the lease from now on.
+	renewed := *lock
+	renewed.Expires = e.leaseExpiry()
+
+	// Convert the lock into JSON format.
+	if err := json.NewEncoder(&buf).Encode(renewed); err != nil {
+		e.Logger.Error("Error encoding lock data", zap.Error(err))
+		return nil, err
+	}
+
+	// Update the lock, guarded by the revision that was read.
+	res, err := e.Client.Index(
+		e.LockIndex,
+		&buf,
+		e.Client.Index.WithContext(e.Ctx),
+		e.Client.Index.WithDocumentID(e.scopeDocumentID()),
+		e.Client.Index.WithIfSeqNo(lock.SeqNo),
+		e.Client.Index.WithIfPrimaryTerm(lock.PrimaryTerm),
+		e.Client.Index.WithRefresh("true"),
 	)
+	if err != nil {
+		e.Logger.Error("Error renewing the lock in Elasticsearch", zap.Error(err))
+		return nil, err
+	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusConflict {
+		e.Logger.Warn("Lock was changed before it could be renewed", zap.String("project", e.Project), zap.String("workspace", e.Workspace))
+		return nil, ErrLockChanged
+	}
+	if res.IsError() {
+		e.Logger.Warn("Failed to renew lock, unknown reason", zap.Int("status_code", res.StatusCode))
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	e.Logger.Info("Lock successfully renewed", zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.Timep("expires", renewed.Expires))
+	return &renewed, nil
+}
+
+// GetLock retrieves the lock currently held on the project and workspace.
+// It returns nil without an error if the project is not locked.
+func (e *Elastic) GetLock() (*ESDistributedLock, error) {
+	// Fetch the lock document from Elasticsearch.
+	res, err := e.Client.Get(
+		e.LockIndex,
+		e.scopeDocumentID(),
+		e.Client.Get.WithContext(e.Ctx),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting the lock", zap.Error(err))
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// A missing document or index means the project is not locked.
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		e.Logger.Warn("Failed to get lock, unknown reason", zap.Int("status_code", res.StatusCode))
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	// Parse the lock from the document source.
+	var doc struct {
+		SeqNo       int               `json:"_seq_no"`
+		PrimaryTerm int               `json:"_primary_term"`
+		Source      ESDistributedLock `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		e.Logger.Error("Error parsing the lock document", zap.Error(err))
+		return nil, err
+	}
+	doc.Source.SeqNo = doc.SeqNo
+	doc.Source.PrimaryTerm = doc.PrimaryTerm
+
+	return &doc.Source, nil
+}
+
+// ReleaseLock attempts to release the lock of the project and workspace.
+// If the lock previously read with GetLock is given, the lock is only released if it hasn't changed since,
+// otherwise ErrLockChanged is returned.
+// Returns true if the lock was successfully released, false if the lock didn't exist.
+func (e *Elastic) ReleaseLock(lock *ESDistributedLock) (bool, error) {
+	return e.releaseLock(lock, LockEventRelease)
+}
+
+// ForceReleaseLock releases the lock like ReleaseLock, but records the release as a force-unlock in the lock history.
+func (e *Elastic) ForceReleaseLock(lock *ESDistributedLock) (bool, error) {
+	return e.releaseLock(lock, LockEventForceUnlock)
+}
+
+// releaseLock deletes the lock document and records the release as the given event in the lock history.
+func (e *Elastic) releaseLock(lock *ESDistributedLock, event string) (bool, error) {
+	opts := []func(*esapi.DeleteRequest){
+		e.Client.Delete.WithContext(e.Ctx),
+		e.Client.Delete.WithRefresh("true"),
+	}
+	if lock != nil {
+		opts = append(opts, e.Client.Delete.WithIfSeqNo(lock.SeqNo), e.Client.Delete.WithIfPrimaryTerm(lock.PrimaryTerm))
+	}
+
+	// Attempt to delete the lock in Elasticsearch.
+	res, err := e.Client.Delete(e.LockIndex, e.scopeDocumentID(), opts...)
 	if err != nil {
 		e.Logger.Error("Error deleting the lock", zap.Error(err))
 		return false, err
 	}
+	defer res.Body.Close()
 
-	// If the lock was successfully deleted or didn't exist, return true.
+	// If the lock was successfully deleted, return true.
 	if res.StatusCode == http.StatusOK {
-		e.Logger.Info("Lock successfully released", zap.String("project", project))
+		e.Logger.Info("Lock successfully released", zap.String("project", e.Project), zap.String("workspace", e.Workspace))
+		e.RecordLockEvent(event, "released", lock, nil)
 		return true, nil
 	} else if res.StatusCode == http.StatusNotFound {
-		e.Logger.Info("Lock did not exist", zap.String("project", project))
+		e.Logger.Info("Lock did not exist", zap.String("project", e.Project), zap.String("workspace", e.Workspace))
 		return false, nil
+	} else if res.StatusCode == http.StatusConflict {
+		e.Logger.Warn("Lock was changed before it could be released", zap.String("project", e.Project), zap.String("workspace", e.Workspace))
+		return false, ErrLockChanged
 	}
 
 	e.Logger.Warn("Failed to release lock, unknown reason", zap.Int("status_code", res.StatusCode))
 	return false, fmt.Errorf("unexpected status code: %d", res.StatusCode)
 }
+
+// ListLocks retrieves all locks stored in the lock index, regardless of their project, oldest first.
+// Locks whose lease has expired are only included if includeExpired is set.
+// The locks are fetched page by page with a point in time, so none are missed however many exist.
+func (e *Elastic) ListLocks(includeExpired bool) ([]ESDistributedLock, error) {
+	// Open a point in time, so the pages are consistent with each other.
+	pitID, err := e.openPointInTime(e.LockIndex)
+	if err != nil {
+		return nil, err
+	}
+	if pitID == "" {
+		// A missing lock index means there are no locks.
+		return []ESDistributedLock{}, nil
+	}
+	defer func() { e.closePointInTime(pitID) }()
+
+	locks := []ESDistributedLock{}
+	var searchAfter []interface{}
+	for {
+		var buf bytes.Buffer
+
+		// Define Elasticsearch query to fetch the next page of locks ordered by their creation time.
+		query := map[string]interface{}{
+			"size":                lockPageSize,
+			"seq_no_primary_term": true,
+			"pit": map[string]interface{}{
+				"id":         pitID,
+				"keep_alive": pointInTimeKeepAlive,
+			},
+			"sort": []map[string]interface{}{
+				{"created": map[string]interface{}{"order": "asc", "unmapped_type": "date"}},
+				{"_shard_doc": map[string]interface{}{"order": "asc"}},
+			},
+		}
+		if searchAfter != nil {
+			query["search_after"] = searchAfter
+		}
+
+		// Encode the Elasticsearch query
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+			return nil, err
+		}
+
+		// Search for the locks in Elasticsearch
+		res, err := e.Client.Search(
+			e.Client.Search.WithContext(e.Ctx),
+			e.Client.Search.WithBody(&buf),
+		)
+		if err != nil {
+			e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+			return nil, err
+		}
+
+		// Parse response from Elasticsearch
+		var r struct {
+			PitID string `json:"pit_id"`
+			Hits  struct {
+				Hits []struct {
+					SeqNo       int               `json:"_seq_no"`
+					PrimaryTerm int               `json:"_primary_term"`
+					Source      ESDistributedLock `json:"_source"`
+					Sort        []interface{}     `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		decoder := json.NewDecoder(res.Body)
+		decoder.UseNumber()
+		err = decoder.Decode(&r)
+		res.Body.Close()
+		if res.IsError() {
+			e.Logger.Error("Error searching the locks", zap.Int("status_code", res.StatusCode))
+			return nil, fmt.Errorf("error searching locks: %s", res.Status())
+		}
+		if err != nil {
+			e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+			return nil, err
+		}
+
+		// The point in time ID may change between pages.
+		if r.PitID != "" {
+			pitID = r.PitID
+		}
+
+		for _, hit := range r.Hits.Hits {
+			searchAfter = hit.Sort
+			lock := hit.Source
+			if lock.Expired() && !includeExpired {
+				continue
+			}
+			lock.SeqNo = hit.SeqNo
+			lock.PrimaryTerm = hit.PrimaryTerm
+			locks = append(locks, lock)
+		}
+
+		// The last page is shorter than the page size.
+		if len(r.Hits.Hits) < lockPageSize {
+			break
+		}
+	}
+
+	return locks, nil
+}
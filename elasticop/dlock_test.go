@@ -0,0 +1,351 @@
+package elasticop
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// contenders is the number of clients racing for the same lock.
+const contenders = 50
+
+// raceForLock lets the clients acquire the lock of the project at the same time, and returns the IDs of the
+// winners and the holders reported to the losers.
+func raceForLock(t *testing.T, clients []*Elastic) ([]string, []*ESDistributedLock) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var winners []string
+	var holders []*ESDistributedLock
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+
+	for i, e := range clients {
+		wg.Add(1)
+		go func(e *Elastic, id string) {
+			defer wg.Done()
+			<-start
+
+			acquired, holder, err := e.AcquireLock("client-"+id, LockInfo{ID: id, Who: "client-" + id, Operation: "OperationTypeApply"})
+			if err != nil {
+				t.Errorf("AcquireLock(%s) failed: %s", id, err)
+				return
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if acquired {
+				winners = append(winners, id)
+			} else {
+				holders = append(holders, holder)
+			}
+		}(e, strconv.Itoa(i))
+	}
+	close(start)
+	wg.Wait()
+
+	return winners, holders
+}
+
+// newContenders returns clients of the same project and workspace.
+func newContenders(newClient func() *Elastic) []*Elastic {
+	clients := make([]*Elastic, contenders)
+	for i := range clients {
+		clients[i] = newClient()
+	}
+	return clients
+}
+
+func TestAcquireLockSingleWinner(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	clients := newContenders(func() *Elastic { return newTestElastic(t, server, "app", DefaultWorkspace) })
+
+	winners, holders := raceForLock(t, clients)
+	if len(winners) != 1 {
+		t.Fatalf("expected a single winner, got %d: %v", len(winners), winners)
+	}
+	if len(holders) != contenders-1 {
+		t.Fatalf("expected %d losers, got %d", contenders-1, len(holders))
+	}
+
+	// Every loser is told who holds the lock.
+	for _, holder := range holders {
+		if holder == nil || holder.Info.ID != winners[0] {
+			t.Fatalf("expected the losers to see holder %s, got %+v", winners[0], holder)
+		}
+	}
+
+	// A single lock document exists, held by the winner.
+	docs := cluster.documents("terraform-locks")
+	if len(docs) != 1 || docs[0].id != "app" {
+		t.Fatalf("expected a single lock document for the project, got %d", len(docs))
+	}
+	lock, err := clients[0].GetLock()
+	if err != nil || lock == nil || lock.Info.ID != winners[0] {
+		t.Fatalf("expected the lock to be held by %s, got %+v (%v)", winners[0], lock, err)
+	}
+}
+
+func TestAcquireLockPerWorkspace(t *testing.T) {
+	_, server := newFakeCluster(t)
+
+	// Locks of different workspaces don't conflict.
+	for _, workspace := range []string{DefaultWorkspace, "staging", "production"} {
+		e := newTestElastic(t, server, "app", workspace)
+		acquired, holder, err := e.AcquireLock("client", LockInfo{ID: workspace})
+		if err != nil || !acquired {
+			t.Fatalf("expected to acquire the lock of workspace %s, got %v, holder %+v (%v)", workspace, acquired, holder, err)
+		}
+	}
+}
+
+func TestAcquireLockTakesOverExpiredLock(t *testing.T) {
+	_, server := newFakeCluster(t)
+
+	// The first holder gets a short lease, which expires.
+	first := newTestElastic(t, server, "app", DefaultWorkspace)
+	first.LockTTL = time.Millisecond
+	acquired, _, err := first.AcquireLock("first", LockInfo{ID: "expired", Who: "first"})
+	if err != nil || !acquired {
+		t.Fatalf("expected to acquire the lock, got %v (%v)", acquired, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Exactly one of the contenders takes over the expired lock.
+	clients := newContenders(func() *Elastic {
+		e := newTestElastic(t, server, "app", DefaultWorkspace)
+		e.LockTTL = time.Hour
+		return e
+	})
+	winners, holders := raceForLock(t, clients)
+	if len(winners) != 1 {
+		t.Fatalf("expected a single winner taking over the expired lock, got %d: %v", len(winners), winners)
+	}
+	for _, holder := range holders {
+		if holder != nil && holder.Info.ID != winners[0] {
+			t.Fatalf("expected the losers to see holder %s, got %s", winners[0], holder.Info.ID)
+		}
+	}
+
+	// The new lock records the evicted holder.
+	lock, err := first.GetLock()
+	if err != nil || lock == nil {
+		t.Fatalf("expected the lock to exist, got %v", err)
+	}
+	if lock.Info.ID != winners[0] {
+		t.Fatalf("expected the lock to be held by %s, got %s", winners[0], lock.Info.ID)
+	}
+	if lock.Evicted == nil || lock.Evicted.ID != "expired" {
+		t.Fatalf("expected the expired holder to be recorded as evicted, got %+v", lock.Evicted)
+	}
+}
+
+func TestAcquireLockKeepsLiveLock(t *testing.T) {
+	_, server := newFakeCluster(t)
+
+	holder := newTestElastic(t, server, "app", DefaultWorkspace)
+	holder.LockTTL = time.Hour
+	if acquired, _, err := holder.AcquireLock("holder", LockInfo{ID: "live"}); err != nil || !acquired {
+		t.Fatalf("expected to acquire the lock, got %v (%v)", acquired, err)
+	}
+
+	// A lock whose lease hasn't expired is not taken over.
+	contender := newTestElastic(t, server, "app", DefaultWorkspace)
+	acquired, current, err := contender.AcquireLock("contender", LockInfo{ID: "contender"})
+	if err != nil || acquired {
+		t.Fatalf("expected the live lock to be kept, got %v (%v)", acquired, err)
+	}
+	if current == nil || current.Info.ID != "live" {
+		t.Fatalf("expected the holder to be reported, got %+v", current)
+	}
+}
+
+func TestAcquireLockRetriesReleasedConflict(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// The conflicting lock is gone by the time it is read, so the lock is created again.
+	cluster.phantomConflicts = 2
+	acquired, holder, err := e.AcquireLock("client", LockInfo{ID: "retried"})
+	if err != nil || !acquired {
+		t.Fatalf("expected to acquire the lock, got %v, holder %+v (%v)", acquired, holder, err)
+	}
+	if lock, err := e.GetLock(); err != nil || lock == nil || lock.Info.ID != "retried" {
+		t.Fatalf("expected the lock to be held, got %+v (%v)", lock, err)
+	}
+
+	// The creation isn't retried forever.
+	other := newTestElastic(t, server, "app", "staging")
+	cluster.phantomConflicts = lockAcquireAttempts
+	if acquired, holder, err := other.AcquireLock("client", LockInfo{ID: "given-up"}); err != nil || acquired || holder != nil {
+		t.Fatalf("expected to give up without a holder, got %v, holder %+v (%v)", acquired, holder, err)
+	}
+}
+
+func TestExtendLeaseKeepsLockAlive(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	e.LockTTL = 200 * time.Millisecond
+
+	if acquired, _, err := e.AcquireLock("client", LockInfo{ID: "held"}); err != nil || !acquired {
+		t.Fatalf("expected to acquire the lock, got %v (%v)", acquired, err)
+	}
+
+	// Extending the lease before it ends keeps the lock from being taken over.
+	for i := 0; i < 3; i++ {
+		time.Sleep(120 * time.Millisecond)
+		lock, err := e.GetLock()
+		if err != nil || lock == nil {
+			t.Fatalf("expected to read the lock, got %v", err)
+		}
+		if _, err := e.ExtendLease(lock); err != nil {
+			t.Fatalf("ExtendLease failed: %s", err)
+		}
+	}
+	contender := newTestElastic(t, server, "app", DefaultWorkspace)
+	if acquired, holder, err := contender.AcquireLock("contender", LockInfo{ID: "contender"}); err != nil || acquired || holder == nil || holder.Info.ID != "held" {
+		t.Fatalf("expected the extended lock to be kept, got %v, holder %+v (%v)", acquired, holder, err)
+	}
+
+	// A lock changed since it was read is not extended.
+	stale, err := e.GetLock()
+	if err != nil || stale == nil {
+		t.Fatalf("expected to read the lock, got %v", err)
+	}
+	if _, err := e.RenewLock("held"); err != nil {
+		t.Fatalf("RenewLock failed: %s", err)
+	}
+	if _, err := e.ExtendLease(stale); !errors.Is(err, ErrLockChanged) {
+		t.Fatalf("expected ErrLockChanged extending a stale lock, got %v", err)
+	}
+}
+
+func TestReleaseLockGuardedBySeqNo(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	e.LockTTL = time.Hour
+
+	if acquired, _, err := e.AcquireLock("client", LockInfo{ID: "held"}); err != nil || !acquired {
+		t.Fatalf("expected to acquire the lock, got %v (%v)", acquired, err)
+	}
+	stale, err := e.GetLock()
+	if err != nil || stale == nil {
+		t.Fatalf("expected to read the lock, got %v", err)
+	}
+
+	// The lock changes after it was read, so releasing the revision read before fails.
+	if _, err := e.RenewLock("held"); err != nil {
+		t.Fatalf("RenewLock failed: %s", err)
+	}
+	released, err := e.ReleaseLock(stale)
+	if !errors.Is(err, ErrLockChanged) || released {
+		t.Fatalf("expected ErrLockChanged releasing a stale lock, got %v (%v)", released, err)
+	}
+	if lock, _ := e.GetLock(); lock == nil {
+		t.Fatal("expected the lock to be kept after a failed release")
+	}
+
+	// Releasing the current revision succeeds, and only once.
+	current, err := e.GetLock()
+	if err != nil || current == nil {
+		t.Fatalf("expected to read the lock, got %v", err)
+	}
+	released, err = e.ReleaseLock(current)
+	if err != nil || !released {
+		t.Fatalf("expected to release the lock, got %v (%v)", released, err)
+	}
+	released, err = e.ReleaseLock(current)
+	if err != nil || released {
+		t.Fatalf("expected the second release to find no lock, got %v (%v)", released, err)
+	}
+}
+
+func TestReleaseLockConcurrentReleases(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	if acquired, _, err := e.AcquireLock("client", LockInfo{ID: "held"}); err != nil || !acquired {
+		t.Fatalf("expected to acquire the lock, got %v (%v)", acquired, err)
+	}
+	lock, err := e.GetLock()
+	if err != nil || lock == nil {
+		t.Fatalf("expected to read the lock, got %v", err)
+	}
+
+	// Many clients release the same revision, only one of them succeeds.
+	var mu sync.Mutex
+	releases := 0
+	var wg sync.WaitGroup
+	for i := 0; i < contenders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			released, err := newTestElastic(t, server, "app", DefaultWorkspace).ReleaseLock(lock)
+			if err != nil && !errors.Is(err, ErrLockChanged) {
+				t.Errorf("ReleaseLock failed: %s", err)
+			}
+			if released {
+				mu.Lock()
+				releases++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if releases != 1 {
+		t.Fatalf("expected a single successful release, got %d", releases)
+	}
+}
+
+func TestListLocksPagesAndSkipsExpired(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// Store locks of many projects, every tenth of them expired, across several pages.
+	const total = 2*lockPageSize + 500
+	base := time.Now().UTC().Add(-time.Hour)
+	expired := 0
+	for i := 0; i < total; i++ {
+		lock := map[string]interface{}{
+			"project":   "project-" + strconv.Itoa(i),
+			"workspace": DefaultWorkspace,
+			"created":   base.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+			"info":      map[string]interface{}{"ID": strconv.Itoa(i)},
+		}
+		if i%10 == 0 {
+			lock["expires"] = base.Format(time.RFC3339)
+			expired++
+		}
+		cluster.put("terraform-locks", "project-"+strconv.Itoa(i), lock)
+	}
+
+	locks, err := e.ListLocks(false)
+	if err != nil {
+		t.Fatalf("ListLocks failed: %s", err)
+	}
+	if len(locks) != total-expired {
+		t.Fatalf("expected %d active locks, got %d", total-expired, len(locks))
+	}
+	for i, lock := range locks {
+		if lock.Expired() {
+			t.Fatalf("expected no expired locks, got %s", lock.Info.ID)
+		}
+		if i > 0 && lock.Created.Before(locks[i-1].Created) {
+			t.Fatalf("expected the locks oldest first, got %s before %s", locks[i-1].Info.ID, lock.Info.ID)
+		}
+	}
+
+	locks, err = e.ListLocks(true)
+	if err != nil {
+		t.Fatalf("ListLocks failed: %s", err)
+	}
+	if len(locks) != total {
+		t.Fatalf("expected %d locks including the expired ones, got %d", total, len(locks))
+	}
+	if cluster.stalePIT != 0 || cluster.openPITs() != 0 {
+		t.Fatalf("expected the latest point in time to be used and closed, got %d stale searches and %d open", cluster.stalePIT, cluster.openPITs())
+	}
+}
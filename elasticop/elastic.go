@@ -3,11 +3,15 @@ package elasticop
 import (
 	"context"
 	"regexp"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"go.uber.org/zap"
 )
 
+// DefaultWorkspace is the workspace used when the request doesn't specify one.
+const DefaultWorkspace = "default"
+
 // Elastic represents a structured Elasticsearch client,
 // encapsulating both the native Elasticsearch client and
 // additional configuration properties specific to your application.
@@ -33,9 +37,43 @@ type Elastic struct {
 	// ResourceIndex represents the index name where terraform resources are stored.
 	ResourceIndex string `vault:"resource_index" default:"terraform-resources"`
 
+	// PointerIndex represents the index name where the pointers to the committed state versions are stored.
+	PointerIndex string `vault:"pointer_index" default:"terraform-state-pointers"`
+
 	// LockIndex represents the index name where terraform locks are stored.
 	LockIndex string `vault:"lock_index" default:"terraform-locks"`
 
+	// LockHistoryIndex represents the index name where the history of lock events is stored.
+	LockHistoryIndex string `vault:"lock_history_index" default:"terraform-lock-history"`
+
+	// AuditIndex represents the index name where audit records of administrative actions are stored.
+	AuditIndex string `vault:"audit_index" default:"terraform-audit"`
+
+	// LockTTL is the default lease length of locks. Zero means locks never expire.
+	LockTTL time.Duration `vault:"lock_ttl" default:"0"`
+
+	// EncryptInclude lists the patterns of the fields to encrypt in the project, in addition to the global patterns.
+	EncryptInclude []string `vault:"encrypt_include"`
+
+	// EncryptExclude lists the patterns of the fields which are not encrypted in the project,
+	// even if they match an included pattern.
+	EncryptExclude []string `vault:"encrypt_exclude"`
+
+	// EncryptRawState enables encrypting the raw state even if no fields of the state are encrypted.
+	EncryptRawState bool `vault:"encrypt_raw_state" default:"false"`
+
+	// ManageTemplates enables installing missing or outdated index templates when connecting to the cluster.
+	ManageTemplates bool `vault:"manage_templates" default:"true"`
+
+	// RetentionKeepVersions is the number of the latest versions of the state which are never pruned.
+	RetentionKeepVersions int `vault:"retention_keep_versions" default:"0"`
+
+	// RetentionKeepDays is the number of days for which every version of the state is kept.
+	RetentionKeepDays int `vault:"retention_keep_days" default:"0"`
+
+	// RetentionKeepDaily keeps the first version of the state of each day when pruning.
+	RetentionKeepDaily bool `vault:"retention_keep_daily" default:"false"`
+
 	// CloudID is the identifier for Elastic Cloud deployments.
 	CloudID string `vault:"cloud_id"`
 
@@ -51,12 +89,30 @@ type Elastic struct {
 	// CaCert specifies the path to the Certificate Authority certificate for Elasticsearch.
 	CaCert string
 
+	// BulkBatchSize is the maximum number of documents sent in a single bulk request.
+	BulkBatchSize int
+
+	// BulkFlushBytes is the size of a bulk request body after which it is sent.
+	BulkFlushBytes int
+
 	// Project denotes the specific project or context.
 	Project string
 
+	// Workspace denotes the Terraform workspace within the project.
+	Workspace string
+
+	// Author is the user on whose behalf the state is changed, recorded in the version history.
+	Author string
+
 	// Encrypt contains compiled regex patterns used to determine which fields to encrypt.
 	Encrypt []*regexp.Regexp
 
+	// encryptExclude contains the compiled patterns of EncryptExclude.
+	encryptExclude []*regexp.Regexp
+
+	// EncryptSensitive enables encrypting the values Terraform flags as sensitive, in addition to the patterns.
+	EncryptSensitive bool
+
 	// Logger is the logger instance.
 	Logger *zap.Logger
 }
@@ -9,15 +9,115 @@ import (
 	"go.uber.org/zap"
 )
 
-// GetState retrieves the latest state stored in Elasticsearch, which includes the state itself
+// GetState retrieves the committed state stored in Elasticsearch, which includes the state itself
 // and associated resources. It returns the combined state as a JSON byte slice.
 func (e *Elastic) GetState() ([]byte, int, error) {
+	source, _, err := e.currentState()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// No state has been stored yet, or the latest version is a tombstone of a deleted state.
+	if source == nil || source["deleted"] == true {
+		e.Logger.Info("State not found", zap.String("project", e.Project))
+		return nil, http.StatusNotFound, fmt.Errorf("state not found")
+	}
+
+	timestamp, _ := source["timestamp"].(string)
 
+	jsonData, err := e.renderState(source)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	e.Logger.Info("Successfully retrieved state from Elasticsearch", zap.String("timestamp", timestamp), zap.String("project", e.Project))
+	return jsonData, http.StatusOK, nil
+}
+
+// renderState returns the Terraform state of a state document as JSON. The raw state is returned as it was
+// posted if the document has one. Otherwise the state is reconstructed: the resources of the version are added,
+// the fields added by the backend are removed and the encrypted fields are decrypted.
+func (e *Elastic) renderState(source map[string]interface{}) ([]byte, error) {
+	// Serve the raw state if it was stored.
+	raw, err := e.decodeRawState(source)
+	if err != nil {
+		return nil, fmt.Errorf("error reading raw state: %s", err)
+	}
+	if raw != nil {
+		return raw, nil
+	}
+
+	timestamp, _ := source["timestamp"].(string)
+	generation, _ := source["generation"].(string)
+
+	// Get the resources connected to the state
+	resources, err := e.GetResources(generation, timestamp)
+	if err != nil {
+		e.Logger.Error("Error fetching the resources from Elasticsearch", zap.Error(err))
+		return nil, fmt.Errorf("error fetching resources: %s", err)
+	}
+	source["resources"] = resources
+
+	// Remove the fields added for scoping the documents.
+	stripInternalFields(source)
+	for _, resource := range resources {
+		stripInternalFields(resource)
+	}
+
+	// Decrypt encrypted fields, failing rather than serving a state with values left encrypted.
+	if err := e.TraverseAndModify(source, e.Encrypt, false); err != nil {
+		return nil, fmt.Errorf("error decrypting values: %s", err)
+	}
+
+	// Marshal state data to response json
+	jsonData, err := json.Marshal(source)
+	if err != nil {
+		e.Logger.Error("Failed to marshal state data to response", zap.Error(err))
+		return nil, fmt.Errorf("failed to marshal state data: %s", err)
+	}
+	return jsonData, nil
+}
+
+// resourcePageSize is the number of resources fetched from Elasticsearch per request.
+const resourcePageSize = 1000
+
+// pointInTimeKeepAlive is how long a point in time is kept open between the pages of a search.
+const pointInTimeKeepAlive = "1m"
+
+// internalFields lists the fields added to the state and resource documents by the backend,
+// which are not part of the Terraform state.
+var internalFields = []string{"project", "workspace", "generation", "previous", "position", "committed", "author", "resource_count", "size", "raw_state"}
+
+// stripInternalFields removes the fields added by the backend from the document.
+func stripInternalFields(doc map[string]interface{}) {
+	for _, field := range internalFields {
+		delete(doc, field)
+	}
+}
+
+// committedQuery returns a query which matches the state documents of the project and workspace,
+// except the versions which are known to be uncommitted.
+func (e *Elastic) committedQuery() map[string]interface{} {
+	return map[string]interface{}{
+		"bool": map[string]interface{}{
+			"filter": e.scopeQuery(),
+			"must_not": map[string]interface{}{
+				"term": map[string]interface{}{"committed": false},
+			},
+		},
+	}
+}
+
+// latestState retrieves the source of the latest state document which isn't known to be uncommitted,
+// without its resources. It is used for states stored before state pointers were introduced.
+// It returns nil if no state has been stored yet.
+func (e *Elastic) latestState() (map[string]interface{}, error) {
 	var buf bytes.Buffer
 
-	// Define Elasticsearch query to fetch the latest state based on the timestamp.
+	// Define Elasticsearch query to fetch the latest state of the project based on the timestamp.
 	query := map[string]interface{}{
-		"size": 1,
+		"query": e.committedQuery(),
+		"size":  1,
 		"sort": []map[string]interface{}{
 			{
 				"timestamp": map[string]interface{}{
@@ -29,7 +129,7 @@ func (e *Elastic) GetState() ([]byte, int, error) {
 	// Encode the Elasticsearch query
 	if err := json.NewEncoder(&buf).Encode(query); err != nil {
 		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
-		return nil, http.StatusInternalServerError, fmt.Errorf("error encoding query: %s", err)
+		return nil, fmt.Errorf("error encoding query: %s", err)
 	}
 
 	// Search Elasticsearch for the state data
@@ -42,103 +142,198 @@ func (e *Elastic) GetState() ([]byte, int, error) {
 	if err != nil {
 		// Error getting the respose
 		e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
-		return nil, http.StatusInternalServerError, fmt.Errorf("error getting response: %s", err)
+		return nil, fmt.Errorf("error getting response: %s", err)
 	}
 	defer res.Body.Close()
 
+	// A missing state index means no state has been stored yet.
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
 	if res.IsError() {
-		e.Logger.Error("Error finding the document in Elasticsearch", zap.Error(err))
-		return nil, http.StatusNotFound, fmt.Errorf("state not found")
+		e.Logger.Error("Error finding the document in Elasticsearch", zap.Int("status_code", res.StatusCode))
+		return nil, fmt.Errorf("error finding state: %s", res.String())
 	}
 
 	// Parse response from the Elasticsearch
 	var esResponse map[string]interface{}
 	if err := json.NewDecoder(res.Body).Decode(&esResponse); err != nil {
 		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
-		return nil, http.StatusInternalServerError, fmt.Errorf("error parsing Elasticsearch response: %s", err)
+		return nil, fmt.Errorf("error parsing Elasticsearch response: %s", err)
 	}
 
-	// Get the "source" and "timestamp" variables from the result
-	var timestamp string
+	// Get the "source" variable from the result
 	var source map[string]interface{}
 	if hits, ok := esResponse["hits"].(map[string]interface{}); ok {
 		if hitList, ok := hits["hits"].([]interface{}); ok && len(hitList) > 0 {
 			hitMap := hitList[0].(map[string]interface{})
 			source = hitMap["_source"].(map[string]interface{})
-			timestamp = source["timestamp"].(string)
 		}
 	}
+	return source, nil
+}
 
-	// Get the resources connected to the state
-	resources, err := e.GetResources(timestamp)
+// GetResources retrieves the resources associated with a given generation from Elasticsearch.
+// States stored before generations were introduced have no generation, and their resources
+// are matched by the timestamp instead.
+// All matching resources are paged through with a point in time, in the order they had in the stored state.
+// It returns the resources as a slice of map[string]interface{}.
+func (e *Elastic) GetResources(generation, timestamp string) ([]map[string]interface{}, error) {
+	link := resourceLink(generation, timestamp)
+
+	// Open a point in time, so the pages are consistent with each other.
+	pitID, err := e.openPointInTime(e.ResourceIndex)
 	if err != nil {
-		e.Logger.Error("Error fetching the resources from Elasticsearch", zap.Error(err))
-		return nil, http.StatusInternalServerError, fmt.Errorf("error fetching resources: %s", err)
+		return nil, err
 	}
-	source["resources"] = resources
+	if pitID == "" {
+		// The resource index doesn't exist yet.
+		return []map[string]interface{}{}, nil
+	}
+	defer func() { e.closePointInTime(pitID) }()
 
-	// Decrypt encrypted fields
-	e.TraverseAndModify(source, e.Encrypt, false)
+	resources := []map[string]interface{}{}
+	var searchAfter []interface{}
+	for {
+		var buf bytes.Buffer
 
-	// Marshal state data to response json
-	jsonData, err := json.Marshal(source)
-	if err != nil {
-		e.Logger.Error("Failed to marshal state data to response", zap.Error(err))
-		return nil, http.StatusInternalServerError, fmt.Errorf("failed to marshal state data: %s", err)
+		// Define Elasticsearch query to fetch the next page of resources of the project based on the generation.
+		// Resources stored before their position was recorded are sorted last.
+		query := map[string]interface{}{
+			"query": e.scopeQuery(link),
+			"size":  resourcePageSize,
+			"pit": map[string]interface{}{
+				"id":         pitID,
+				"keep_alive": pointInTimeKeepAlive,
+			},
+			"sort": []map[string]interface{}{
+				{"position": map[string]interface{}{"order": "asc", "missing": "_last", "unmapped_type": "long"}},
+				{"_shard_doc": map[string]interface{}{"order": "asc"}},
+			},
+		}
+		if searchAfter != nil {
+			query["search_after"] = searchAfter
+		}
+
+		// Encode the Elasticsearch query
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+			return nil, err
+		}
+
+		// Search for the resources in Elasticsearch
+		res, err := e.Client.Search(
+			e.Client.Search.WithContext(e.Ctx),
+			e.Client.Search.WithBody(&buf),
+		)
+		if err != nil {
+			e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+			return nil, err
+		}
+
+		// Parse response from Elasticsearch, keeping numbers as they were stored
+		var r map[string]interface{}
+		decoder := json.NewDecoder(res.Body)
+		decoder.UseNumber()
+		err = decoder.Decode(&r)
+		res.Body.Close()
+		if res.IsError() {
+			e.Logger.Error("Error searching the resources", zap.Int("status_code", res.StatusCode))
+			return nil, fmt.Errorf("error searching resources: %s", res.Status())
+		}
+		if err != nil {
+			e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+			return nil, err
+		}
+
+		// The point in time ID may change between pages.
+		if id, ok := r["pit_id"].(string); ok && id != "" {
+			pitID = id
+		}
+
+		var hitList []interface{}
+		if hits, ok := r["hits"].(map[string]interface{}); ok {
+			hitList, _ = hits["hits"].([]interface{})
+		}
+		for _, hit := range hitList {
+			hitMap := hit.(map[string]interface{})
+			source := hitMap["_source"].(map[string]interface{})
+			resources = append(resources, source)
+			searchAfter, _ = hitMap["sort"].([]interface{})
+		}
+
+		// The last page is shorter than the page size.
+		if len(hitList) < resourcePageSize {
+			break
+		}
 	}
 
-	e.Logger.Info("Successfully retrieved state from Elasticsearch", zap.String("timestamp", timestamp), zap.String("project", e.Project))
-	return jsonData, http.StatusOK, nil
+	return resources, nil
 }
 
-// GetResources retrieves the resources associated with a given timestamp from Elasticsearch.
-// It returns the resources as a slice of map[string]interface{}.
-func (e *Elastic) GetResources(timestamp string) ([]map[string]interface{}, error) {
-	var buf bytes.Buffer
-
-	// Define Elasticsearch query to fetch resources based on the timestamp.
-	query := map[string]interface{}{
-		"query": map[string]interface{}{
+// resourceLink returns the query matching the resources of a state by generation,
+// or by timestamp for states without a generation.
+func resourceLink(generation, timestamp string) map[string]interface{} {
+	if generation == "" {
+		return map[string]interface{}{
 			"match": map[string]interface{}{
 				"timestamp": timestamp,
 			},
-		},
+		}
 	}
-
-	// Encode the Elasticsearch query
-	if err := json.NewEncoder(&buf).Encode(query); err != nil {
-		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
-		return nil, err
+	return map[string]interface{}{
+		"term": map[string]interface{}{
+			"generation": generation,
+		},
 	}
+}
 
-	// Search for the resources in Elasticsearch
-	res, err := e.Client.Search(
-		e.Client.Search.WithContext(e.Ctx),
-		e.Client.Search.WithIndex(e.ResourceIndex),
-		e.Client.Search.WithBody(&buf),
+// openPointInTime opens a point in time on the index and returns its ID.
+// It returns an empty ID if the index doesn't exist.
+func (e *Elastic) openPointInTime(index string) (string, error) {
+	res, err := e.Client.OpenPointInTime(
+		[]string{index},
+		pointInTimeKeepAlive,
+		e.Client.OpenPointInTime.WithContext(e.Ctx),
 	)
 	if err != nil {
-		e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
-		return nil, err
+		e.Logger.Error("Error opening point in time", zap.String("index", index), zap.Error(err))
+		return "", err
 	}
 	defer res.Body.Close()
 
-	// Parse response from Elasticsearch
-	var r map[string]interface{}
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.IsError() {
+		e.Logger.Error("Failed to open point in time", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+		return "", fmt.Errorf("error opening point in time: %s", res.String())
+	}
+
+	var r struct {
+		ID string `json:"id"`
+	}
 	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
 		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
-		return nil, err
+		return "", err
+	}
+	return r.ID, nil
+}
+
+// closePointInTime releases the point in time. Failures are only logged, as it expires on its own.
+func (e *Elastic) closePointInTime(id string) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"id": id}); err != nil {
+		return
 	}
 
-	var resources []map[string]interface{}
-	if hits, ok := r["hits"].(map[string]interface{}); ok {
-		if hitList, ok := hits["hits"].([]interface{}); ok {
-			for _, hit := range hitList {
-				hitMap := hit.(map[string]interface{})
-				source := hitMap["_source"].(map[string]interface{})
-				resources = append(resources, source)
-			}
-		}
+	res, err := e.Client.ClosePointInTime(
+		e.Client.ClosePointInTime.WithContext(e.Ctx),
+		e.Client.ClosePointInTime.WithBody(&buf),
+	)
+	if err != nil {
+		e.Logger.Warn("Error closing point in time", zap.Error(err))
+		return
 	}
-	return resources, nil
+	res.Body.Close()
 }
@@ -0,0 +1,65 @@
+package elasticop
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestGetResourcesPagesInOrder(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// Store the resources of a state across several pages, in shuffled order, together with resources
+	// of another generation and of another workspace which must not be returned.
+	const total = 3*resourcePageSize + 500
+	for i := 0; i < total; i++ {
+		position := (i * 7919) % total
+		cluster.put("terraform-resources", "", map[string]interface{}{
+			"project": "app", "workspace": DefaultWorkspace, "generation": "current",
+			"position": position, "name": "resource-" + strconv.Itoa(position),
+		})
+		if i%100 == 0 {
+			cluster.put("terraform-resources", "", map[string]interface{}{
+				"project": "app", "workspace": DefaultWorkspace, "generation": "previous", "position": position,
+			})
+			cluster.put("terraform-resources", "", map[string]interface{}{
+				"project": "app", "workspace": "staging", "generation": "current", "position": position,
+			})
+		}
+	}
+
+	resources, err := e.GetResources("current", "")
+	if err != nil {
+		t.Fatalf("GetResources failed: %s", err)
+	}
+	if len(resources) != total {
+		t.Fatalf("expected %d resources, got %d", total, len(resources))
+	}
+	for i, resource := range resources {
+		if name := fmt.Sprint(resource["name"]); name != "resource-"+strconv.Itoa(i) {
+			t.Fatalf("expected resource-%d at position %d, got %s", i, i, name)
+		}
+	}
+
+	// Every page used the point in time ID returned by the previous one, and the last one was closed.
+	if cluster.stalePIT != 0 {
+		t.Fatalf("expected no searches with an outdated point in time ID, got %d", cluster.stalePIT)
+	}
+	if cluster.searches < 4 {
+		t.Fatalf("expected the resources to be fetched in several pages, got %d searches", cluster.searches)
+	}
+	if open := cluster.openPITs(); open != 0 {
+		t.Fatalf("expected the point in time to be closed, got %d open", open)
+	}
+}
+
+func TestGetResourcesMissingIndex(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	resources, err := e.GetResources("current", "")
+	if err != nil || len(resources) != 0 {
+		t.Fatalf("expected no resources without an index, got %d (%v)", len(resources), err)
+	}
+}
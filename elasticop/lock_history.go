@@ -0,0 +1,115 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Lock events recorded in the lock history index.
+const (
+	LockEventAcquire     = "acquire"
+	LockEventRelease     = "release"
+	LockEventForceUnlock = "force-unlock"
+	LockEventEvict       = "evict"
+	LockEventContention  = "contention"
+)
+
+// lockHistoryMappings defines the mappings of the index where the lock history is stored.
+var lockHistoryMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"timestamp":             map[string]interface{}{"type": "date"},
+		"project":               map[string]interface{}{"type": "keyword"},
+		"workspace":             map[string]interface{}{"type": "keyword"},
+		"event":                 map[string]interface{}{"type": "keyword"},
+		"outcome":               map[string]interface{}{"type": "keyword"},
+		"lock_id":               map[string]interface{}{"type": "keyword"},
+		"holder":                map[string]interface{}{"type": "keyword"},
+		"operation":             map[string]interface{}{"type": "keyword"},
+		"locked_by":             map[string]interface{}{"type": "keyword"},
+		"acquired":              map[string]interface{}{"type": "date"},
+		"duration_held_seconds": map[string]interface{}{"type": "double"},
+		"contender":             map[string]interface{}{"type": "keyword"},
+		"contender_operation":   map[string]interface{}{"type": "keyword"},
+	},
+}
+
+// LockEvent represents an entry of the lock history.
+type LockEvent struct {
+	Timestamp           time.Time  `json:"timestamp"`
+	Project             string     `json:"project"`
+	Workspace           string     `json:"workspace"`
+	Event               string     `json:"event"`
+	Outcome             string     `json:"outcome"`
+	LockID              string     `json:"lock_id"`
+	Holder              string     `json:"holder"`
+	Operation           string     `json:"operation"`
+	LockedBy            string     `json:"locked_by"`
+	Acquired            *time.Time `json:"acquired,omitempty"`
+	DurationHeldSeconds float64    `json:"duration_held_seconds,omitempty"`
+	Contender           string     `json:"contender,omitempty"`
+	ContenderOperation  string     `json:"contender_operation,omitempty"`
+}
+
+// RecordLockEvent appends an event concerning the given lock to the lock history index.
+// For releases and evictions the time the lock was held is recorded, and for contention the client
+// which was denied the lock. Failures are logged, but don't affect the locking itself.
+func (e *Elastic) RecordLockEvent(event, outcome string, lock *ESDistributedLock, contender *LockInfo) {
+	var buf bytes.Buffer
+	now := time.Now().UTC()
+
+	entry := LockEvent{
+		Timestamp: now,
+		Project:   e.Project,
+		Workspace: e.Workspace,
+		Event:     event,
+		Outcome:   outcome,
+	}
+	if lock != nil {
+		entry.LockID = lock.Info.ID
+		entry.Holder = lock.Info.Who
+		entry.Operation = lock.Info.Operation
+		entry.LockedBy = lock.LockedBy
+		if !lock.Created.IsZero() {
+			acquired := lock.Created
+			entry.Acquired = &acquired
+			if event == LockEventRelease || event == LockEventForceUnlock || event == LockEventEvict {
+				entry.DurationHeldSeconds = now.Sub(lock.Created).Seconds()
+			}
+		}
+	}
+	if contender != nil {
+		entry.Contender = contender.Who
+		entry.ContenderOperation = contender.Operation
+	}
+
+	// Make sure the lock history index exists with the proper mappings.
+	if err := e.ensureIndex(e.LockHistoryIndex, lockHistoryMappings); err != nil {
+		e.Logger.Error("Failed to record lock event", zap.String("event", event), zap.Error(err))
+		return
+	}
+
+	// Encode the lock event.
+	if err := json.NewEncoder(&buf).Encode(entry); err != nil {
+		e.Logger.Error("Error encoding lock event", zap.Error(err))
+		return
+	}
+
+	// Save the lock event to Elasticsearch.
+	res, err := e.Client.Index(
+		e.LockHistoryIndex,
+		&buf,
+		e.Client.Index.WithContext(e.Ctx),
+	)
+	if err != nil {
+		e.Logger.Error("Error saving lock event to Elasticsearch", zap.String("event", event), zap.Error(err))
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		e.Logger.Error("Failed to save lock event", zap.String("event", event), zap.Int("status_code", res.StatusCode))
+	}
+}
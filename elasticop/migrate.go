@@ -0,0 +1,82 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+// BackfillProject tags the state and resource documents which don't belong to any project yet
+// with the project and workspace. It is used to migrate documents stored before states were scoped to projects.
+// It returns the number of updated documents.
+func (e *Elastic) BackfillProject() (int64, error) {
+	var total int64
+
+	for _, index := range []string{e.StateIndex, e.ResourceIndex} {
+		var buf bytes.Buffer
+
+		// Make sure the project fields are mapped as keywords before they are filled.
+		if err := e.ensureIndex(index, stateDocumentMappings); err != nil {
+			return total, err
+		}
+
+		// Define the update to set the project and workspace on the untagged documents.
+		query := map[string]interface{}{
+			"query": map[string]interface{}{
+				"bool": map[string]interface{}{
+					"must_not": map[string]interface{}{
+						"exists": map[string]interface{}{"field": "project"},
+					},
+				},
+			},
+			"script": map[string]interface{}{
+				"source": "ctx._source.project = params.project; ctx._source.workspace = params.workspace",
+				"lang":   "painless",
+				"params": map[string]interface{}{
+					"project":   e.Project,
+					"workspace": e.Workspace,
+				},
+			},
+		}
+
+		// Encode the update query.
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+			return total, err
+		}
+
+		// Update the documents in Elasticsearch.
+		res, err := e.Client.UpdateByQuery(
+			[]string{index},
+			e.Client.UpdateByQuery.WithContext(e.Ctx),
+			e.Client.UpdateByQuery.WithBody(&buf),
+			e.Client.UpdateByQuery.WithRefresh(true),
+		)
+		if err != nil {
+			e.Logger.Error("Error updating documents in Elasticsearch", zap.String("index", index), zap.Error(err))
+			return total, err
+		}
+		defer res.Body.Close()
+
+		if res.IsError() {
+			e.Logger.Error("Failed to update documents", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+			return total, fmt.Errorf("error updating documents in %s: %s", index, res.String())
+		}
+
+		// Parse the number of updated documents.
+		var r struct {
+			Updated int64 `json:"updated"`
+		}
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+			e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+			return total, err
+		}
+
+		e.Logger.Info("Documents tagged with project", zap.String("index", index), zap.String("project", e.Project), zap.Int64("updated", r.Updated))
+		total += r.Updated
+	}
+
+	return total, nil
+}
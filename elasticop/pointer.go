@@ -0,0 +1,588 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"go.uber.org/zap"
+)
+
+// ErrStateChanged is returned when another version of the state was committed concurrently.
+var ErrStateChanged = errors.New("state was changed concurrently")
+
+// uncommittedGracePeriod is how old an uncommitted version must be before it is considered abandoned.
+const uncommittedGracePeriod = "1h"
+
+// pointerMappings defines the mappings of the index where the state pointers are stored.
+var pointerMappings = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"project":    map[string]interface{}{"type": "keyword"},
+		"workspace":  map[string]interface{}{"type": "keyword"},
+		"generation": map[string]interface{}{"type": "keyword"},
+		"timestamp":  map[string]interface{}{"type": "date"},
+		"lineage":    map[string]interface{}{"type": "keyword"},
+		"serial":     map[string]interface{}{"type": "long"},
+	},
+}
+
+// statePointer references the committed version of the state of a project and workspace.
+type statePointer struct {
+	Project    string `json:"project"`
+	Workspace  string `json:"workspace"`
+	Generation string `json:"generation"`
+	Timestamp  string `json:"timestamp"`
+	Lineage    string `json:"lineage,omitempty"`
+	Serial     int64  `json:"serial"`
+
+	// SeqNo and PrimaryTerm identify the revision of the pointer document that was read,
+	// and are used to guard the commit of a new version against concurrent commits.
+	SeqNo       int `json:"-"`
+	PrimaryTerm int `json:"-"`
+}
+
+// getPointer retrieves the pointer to the committed version of the state.
+// It returns nil without an error if no version has been committed yet.
+func (e *Elastic) getPointer() (*statePointer, error) {
+	// Fetch the pointer document from Elasticsearch.
+	res, err := e.Client.Get(
+		e.PointerIndex,
+		e.scopeDocumentID(),
+		e.Client.Get.WithContext(e.Ctx),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting the state pointer", zap.Error(err))
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	// A missing document or index means no version has been committed yet.
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		e.Logger.Warn("Failed to get state pointer, unknown reason", zap.Int("status_code", res.StatusCode))
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	// Parse the pointer from the document source.
+	var doc struct {
+		SeqNo       int          `json:"_seq_no"`
+		PrimaryTerm int          `json:"_primary_term"`
+		Source      statePointer `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		e.Logger.Error("Error parsing the state pointer", zap.Error(err))
+		return nil, err
+	}
+	doc.Source.SeqNo = doc.SeqNo
+	doc.Source.PrimaryTerm = doc.PrimaryTerm
+
+	return &doc.Source, nil
+}
+
+// workspacePageSize is the number of workspaces fetched from Elasticsearch per request.
+const workspacePageSize = 1000
+
+// ListWorkspaces lists the workspaces of the project which have a committed version of the state, in
+// alphabetical order. States which haven't been written since pointers were introduced are not listed.
+func (e *Elastic) ListWorkspaces() ([]string, error) {
+	workspaces := []string{}
+	var searchAfter []interface{}
+	for {
+		var buf bytes.Buffer
+
+		// Define Elasticsearch query to fetch the next page of pointers of the project.
+		// Each workspace has a single pointer, so the workspace alone orders the pages.
+		query := map[string]interface{}{
+			"query":   map[string]interface{}{"term": map[string]interface{}{"project": e.Project}},
+			"size":    workspacePageSize,
+			"_source": []string{"workspace"},
+			"sort":    []map[string]interface{}{{"workspace": map[string]interface{}{"order": "asc"}}},
+		}
+		if searchAfter != nil {
+			query["search_after"] = searchAfter
+		}
+
+		// Encode the Elasticsearch query
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+			return nil, err
+		}
+
+		// Search Elasticsearch for the pointers
+		res, err := e.Client.Search(
+			e.Client.Search.WithContext(e.Ctx),
+			e.Client.Search.WithIndex(e.PointerIndex),
+			e.Client.Search.WithBody(&buf),
+		)
+		if err != nil {
+			e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+			return nil, err
+		}
+
+		var r struct {
+			Hits struct {
+				Hits []struct {
+					Source struct {
+						Workspace string `json:"workspace"`
+					} `json:"_source"`
+					Sort []interface{} `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&r)
+		res.Body.Close()
+
+		// A missing pointer index means no state has been committed yet.
+		if res.StatusCode == http.StatusNotFound {
+			return workspaces, nil
+		}
+		if res.IsError() {
+			e.Logger.Error("Error searching the workspaces", zap.Int("status_code", res.StatusCode))
+			return nil, fmt.Errorf("error searching workspaces: %s", res.Status())
+		}
+		if err != nil {
+			e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+			return nil, err
+		}
+
+		for _, hit := range r.Hits.Hits {
+			workspaces = append(workspaces, hit.Source.Workspace)
+			searchAfter = hit.Sort
+		}
+
+		// The last page is shorter than the page size.
+		if len(r.Hits.Hits) < workspacePageSize {
+			return workspaces, nil
+		}
+	}
+}
+
+// currentState retrieves the source of the committed state document, without its resources,
+// together with the pointer referencing it. States stored before pointers were introduced have no pointer,
+// and the latest state document is returned instead. It returns a nil source if no state has been stored yet.
+func (e *Elastic) currentState() (map[string]interface{}, *statePointer, error) {
+	pointer, err := e.getPointer()
+	if err != nil {
+		return nil, nil, err
+	}
+	if pointer == nil {
+		source, err := e.latestState()
+		return source, nil, err
+	}
+
+	source, err := e.getStateDocument(pointer.Generation)
+	if err != nil {
+		return nil, nil, err
+	}
+	if source == nil {
+		e.Logger.Error("Committed state document is missing", zap.String("project", e.Project), zap.String("generation", pointer.Generation))
+		return nil, nil, fmt.Errorf("committed state %s is missing", pointer.Generation)
+	}
+	return source, pointer, nil
+}
+
+// getStateDocument retrieves the source of the state document of the generation.
+// It returns nil without an error if the document doesn't exist.
+func (e *Elastic) getStateDocument(generation string) (map[string]interface{}, error) {
+	// Fetch the state document from Elasticsearch.
+	res, err := e.Client.Get(
+		e.StateIndex,
+		generation,
+		e.Client.Get.WithContext(e.Ctx),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting the state document", zap.Error(err))
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if res.IsError() {
+		e.Logger.Warn("Failed to get state document, unknown reason", zap.Int("status_code", res.StatusCode))
+		return nil, fmt.Errorf("unexpected status code: %d", res.StatusCode)
+	}
+
+	// Parse the state from the document source.
+	var doc struct {
+		Source map[string]interface{} `json:"_source"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		e.Logger.Error("Error parsing the state document", zap.Error(err))
+		return nil, err
+	}
+
+	// Only return documents of the project.
+	if doc.Source["project"] != e.Project || doc.Source["workspace"] != e.Workspace {
+		return nil, nil
+	}
+	return doc.Source, nil
+}
+
+// writeStateDocument stores the state document of a new, not yet committed version,
+// using the generation as the document ID. The document records the generation the pointer referenced
+// when the version was written, which proves that generation was committed even if it wasn't marked.
+func (e *Elastic) writeStateDocument(generation string, pointer *statePointer, stateMap map[string]interface{}) error {
+	var buf bytes.Buffer
+
+	stateMap["generation"] = generation
+	stateMap["project"] = e.Project
+	stateMap["workspace"] = e.Workspace
+	stateMap["committed"] = false
+	if pointer != nil {
+		stateMap["previous"] = pointer.Generation
+	}
+
+	// Encode the state data.
+	if err := json.NewEncoder(&buf).Encode(stateMap); err != nil {
+		e.Logger.Error("Error encoding state data", zap.Error(err))
+		return err
+	}
+
+	// Save the state data to Elasticsearch.
+	res, err := e.Client.Index(
+		e.StateIndex,
+		&buf,
+		e.Client.Index.WithContext(e.Ctx),
+		e.Client.Index.WithDocumentID(generation),
+		e.Client.Index.WithRefresh("true"),
+	)
+	if err != nil {
+		e.Logger.Error("Error saving state to Elasticsearch", zap.Error(err))
+		return fmt.Errorf("error saving state: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		e.Logger.Error("Error saving state to Elasticsearch", zap.Int("status_code", res.StatusCode))
+		return fmt.Errorf("error saving state: %s", res.String())
+	}
+	return nil
+}
+
+// commitGeneration makes the generation the current version of the state by pointing the state pointer to it.
+// The pointer is only updated if it hasn't changed since it was read, otherwise ErrStateChanged is returned.
+// A nil pointer means that no version has been committed before.
+func (e *Elastic) commitGeneration(pointer *statePointer, stateMap map[string]interface{}) error {
+	var buf bytes.Buffer
+
+	next := statePointer{
+		Project:   e.Project,
+		Workspace: e.Workspace,
+	}
+	next.Generation, _ = stateMap["generation"].(string)
+	next.Timestamp, _ = stateMap["timestamp"].(string)
+	next.Lineage, _ = stateMap["lineage"].(string)
+	if serial, ok := stateMap["serial"].(float64); ok {
+		next.Serial = int64(serial)
+	}
+
+	// Make sure the pointer index exists with the proper mappings.
+	if err := e.ensureIndex(e.PointerIndex, pointerMappings); err != nil {
+		return err
+	}
+
+	// Encode the pointer.
+	if err := json.NewEncoder(&buf).Encode(next); err != nil {
+		e.Logger.Error("Error encoding state pointer", zap.Error(err))
+		return err
+	}
+
+	// Create the pointer, or update it guarded by the revision that was read.
+	var opts []func(*esapi.IndexRequest)
+	opts = append(opts,
+		e.Client.Index.WithContext(e.Ctx),
+		e.Client.Index.WithDocumentID(e.scopeDocumentID()),
+		e.Client.Index.WithRefresh("true"),
+	)
+	if pointer == nil {
+		opts = append(opts, e.Client.Index.WithOpType("create"))
+	} else {
+		opts = append(opts, e.Client.Index.WithIfSeqNo(pointer.SeqNo), e.Client.Index.WithIfPrimaryTerm(pointer.PrimaryTerm))
+	}
+
+	res, err := e.Client.Index(e.PointerIndex, &buf, opts...)
+	if err != nil {
+		e.Logger.Error("Error saving state pointer to Elasticsearch", zap.Error(err))
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusConflict {
+		e.Logger.Warn("State was committed concurrently", zap.String("project", e.Project), zap.String("generation", next.Generation))
+		return ErrStateChanged
+	}
+	if res.IsError() {
+		e.Logger.Error("Error saving state pointer to Elasticsearch", zap.Int("status_code", res.StatusCode))
+		return fmt.Errorf("error saving state pointer: %s", res.String())
+	}
+
+	// Mark the state document as committed. The pointer is authoritative, so a failure is only logged.
+	if err := e.markCommitted(next.Generation); err != nil {
+		e.Logger.Warn("Failed to mark state as committed", zap.String("generation", next.Generation), zap.Error(err))
+	}
+
+	return nil
+}
+
+// markCommitted flags the state document of the generation as committed.
+func (e *Elastic) markCommitted(generation string) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(map[string]interface{}{"doc": map[string]interface{}{"committed": true}}); err != nil {
+		return err
+	}
+
+	res, err := e.Client.Update(
+		e.StateIndex,
+		generation,
+		&buf,
+		e.Client.Update.WithContext(e.Ctx),
+		e.Client.Update.WithRefresh("true"),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error marking state as committed: %s", res.String())
+	}
+	return nil
+}
+
+// CleanupUncommitted removes the versions of the state which were written, but never committed,
+// for example because a write failed midway. Only versions older than the grace period are removed,
+// so writes in progress are not affected. Versions which were committed, but not marked as committed,
+// are recognized by the current pointer or by a later version written while the pointer referenced them,
+// and are marked instead of removed.
+func (e *Elastic) CleanupUncommitted() error {
+	var buf bytes.Buffer
+
+	pointer, err := e.getPointer()
+	if err != nil {
+		return err
+	}
+
+	// Define Elasticsearch query to fetch the abandoned versions of the project.
+	query := map[string]interface{}{
+		"query": e.scopeQuery(
+			map[string]interface{}{"term": map[string]interface{}{"committed": false}},
+			map[string]interface{}{"range": map[string]interface{}{"timestamp": map[string]interface{}{"lt": "now-" + uncommittedGracePeriod}}},
+		),
+		"size":    100,
+		"_source": []string{"generation"},
+	}
+
+	// Encode the Elasticsearch query
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+		return err
+	}
+
+	// Search Elasticsearch for the abandoned versions
+	res, err := e.Client.Search(
+		e.Client.Search.WithContext(e.Ctx),
+		e.Client.Search.WithIndex(e.StateIndex),
+		e.Client.Search.WithBody(&buf),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("error searching uncommitted states: %s", res.String())
+	}
+
+	var r struct {
+		Hits struct {
+			Hits []struct {
+				ID string `json:"_id"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+		return err
+	}
+
+	for _, hit := range r.Hits.Hits {
+		committed := pointer != nil && hit.ID == pointer.Generation
+		if !committed {
+			if committed, err = e.hasSuccessor(hit.ID); err != nil {
+				return err
+			}
+		}
+
+		// The committed version was only left unmarked, so repair it instead of removing it.
+		if committed {
+			if err := e.markCommitted(hit.ID); err != nil {
+				e.Logger.Warn("Failed to mark state as committed", zap.String("generation", hit.ID), zap.Error(err))
+			}
+			continue
+		}
+
+		if err := e.deleteVersion(hit.ID, hit.ID, ""); err != nil {
+			return err
+		}
+		e.Logger.Info("Removed uncommitted state version", zap.String("project", e.Project), zap.String("generation", hit.ID))
+	}
+
+	return nil
+}
+
+// hasSuccessor reports whether a version of the state was written while the pointer referenced the
+// generation, which means that the generation was committed.
+func (e *Elastic) hasSuccessor(generation string) (bool, error) {
+	var buf bytes.Buffer
+
+	query := map[string]interface{}{
+		"query":   e.scopeQuery(map[string]interface{}{"term": map[string]interface{}{"previous": generation}}),
+		"size":    1,
+		"_source": false,
+	}
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+		return false, err
+	}
+
+	res, err := e.Client.Search(
+		e.Client.Search.WithContext(e.Ctx),
+		e.Client.Search.WithIndex(e.StateIndex),
+		e.Client.Search.WithBody(&buf),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return false, fmt.Errorf("error searching later states: %s", res.String())
+	}
+
+	var r struct {
+		Hits struct {
+			Hits []json.RawMessage `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+		return false, err
+	}
+	return len(r.Hits.Hits) > 0, nil
+}
+
+// deleteVersion removes the resource documents and the state document of a version of the state.
+// The resources are matched by the generation, or by the timestamp for versions without a generation.
+// The resources of a version without a generation are kept while another version shares its timestamp,
+// as they can't be told apart; they are removed with the last of these versions.
+func (e *Elastic) deleteVersion(id, generation, timestamp string) error {
+	if generation == "" {
+		shared, err := e.sharesTimestamp(timestamp)
+		if err != nil {
+			return err
+		}
+		if shared {
+			e.Logger.Warn("Keeping the resources of a version sharing its timestamp", zap.String("version", id), zap.String("timestamp", timestamp))
+			return e.deleteStateDocument(id)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	// Define the query matching the resources of the version.
+	query := map[string]interface{}{
+		"query": e.scopeQuery(resourceLink(generation, timestamp)),
+	}
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+		return err
+	}
+
+	// Delete the resources first, so a failure never leaves resources without their state document.
+	res, err := e.Client.DeleteByQuery(
+		[]string{e.ResourceIndex},
+		&buf,
+		e.Client.DeleteByQuery.WithContext(e.Ctx),
+		e.Client.DeleteByQuery.WithRefresh(true),
+	)
+	if err != nil {
+		e.Logger.Error("Error deleting resources", zap.String("version", id), zap.Error(err))
+		return err
+	}
+	res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error deleting resources of %s: %s", id, res.Status())
+	}
+
+	return e.deleteStateDocument(id)
+}
+
+// deleteStateDocument removes the state document of a version of the state.
+func (e *Elastic) deleteStateDocument(id string) error {
+	res, err := e.Client.Delete(
+		e.StateIndex,
+		id,
+		e.Client.Delete.WithContext(e.Ctx),
+		e.Client.Delete.WithRefresh("true"),
+	)
+	if err != nil {
+		e.Logger.Error("Error deleting state", zap.String("version", id), zap.Error(err))
+		return err
+	}
+	res.Body.Close()
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("error deleting state %s: %s", id, res.Status())
+	}
+
+	return nil
+}
+
+// sharesTimestamp reports whether more than one version of the state was written with the timestamp.
+func (e *Elastic) sharesTimestamp(timestamp string) (bool, error) {
+	var buf bytes.Buffer
+
+	query := map[string]interface{}{
+		"query":   e.scopeQuery(map[string]interface{}{"match": map[string]interface{}{"timestamp": timestamp}}),
+		"size":    2,
+		"_source": false,
+	}
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+		return false, err
+	}
+
+	res, err := e.Client.Search(
+		e.Client.Search.WithContext(e.Ctx),
+		e.Client.Search.WithIndex(e.StateIndex),
+		e.Client.Search.WithBody(&buf),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return false, fmt.Errorf("error searching states by timestamp: %s", res.String())
+	}
+
+	var r struct {
+		Hits struct {
+			Hits []json.RawMessage `json:"hits"`
+		} `json:"hits"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+		return false, err
+	}
+	return len(r.Hits.Hits) > 1, nil
+}
@@ -0,0 +1,155 @@
+package elasticop
+
+import (
+	"testing"
+	"time"
+)
+
+// ageDocuments moves the timestamp of the documents of the index past the grace period of uncommitted versions.
+func ageDocuments(cluster *fakeCluster, index string) {
+	old := time.Now().UTC().Add(-2 * time.Hour).Format(time.RFC3339)
+	for _, doc := range cluster.documents(index) {
+		source := map[string]interface{}{}
+		for key, value := range doc.source {
+			source[key] = value
+		}
+		source["timestamp"] = old
+		cluster.put(index, doc.id, source)
+	}
+}
+
+// storeGeneration stores the state and returns the generation it was committed as.
+func storeGeneration(t *testing.T, e *Elastic, state []byte) string {
+	t.Helper()
+	if httpStatus, err := e.StoreState(state, false); err != nil {
+		t.Fatalf("StoreState failed with %d: %s", httpStatus, err)
+	}
+	pointer, err := e.getPointer()
+	if err != nil || pointer == nil {
+		t.Fatalf("expected the state to be committed, got %v", err)
+	}
+	return pointer.Generation
+}
+
+func TestCleanupUncommittedKeepsCommittedVersions(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// Both versions are committed, but marking them as committed fails.
+	cluster.failUpdates = 1
+	first := storeGeneration(t, e, stateJSON("lineage", 1))
+	cluster.failUpdates = 1
+	second := storeGeneration(t, e, stateJSON("lineage", 2))
+
+	// A write which lost the race against the second version was abandoned.
+	cluster.put("terraform-state", "abandoned", map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "generation": "abandoned", "previous": first,
+		"committed": false, "serial": 2, "lineage": "lineage",
+	})
+	cluster.put("terraform-resources", "", map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "generation": "abandoned", "position": 0,
+	})
+	ageDocuments(cluster, "terraform-state")
+
+	if err := e.CleanupUncommitted(); err != nil {
+		t.Fatalf("CleanupUncommitted failed: %s", err)
+	}
+
+	// The committed versions are kept with their resources and marked, only the abandoned version is removed.
+	for _, generation := range []string{first, second} {
+		if source, err := e.getStateDocument(generation); err != nil || source == nil || source["committed"] != true {
+			t.Errorf("expected version %s to be kept and marked as committed, got %v (%v)", generation, source, err)
+		}
+		if resources, err := e.GetResources(generation, ""); err != nil || len(resources) != 1 {
+			t.Errorf("expected the resources of version %s to be kept, got %d (%v)", generation, len(resources), err)
+		}
+	}
+	if source, err := e.getStateDocument("abandoned"); err != nil || source != nil {
+		t.Errorf("expected the abandoned version to be removed, got %v (%v)", source, err)
+	}
+	if resources, err := e.GetResources("abandoned", ""); err != nil || len(resources) != 0 {
+		t.Errorf("expected the resources of the abandoned version to be removed, got %d (%v)", len(resources), err)
+	}
+}
+
+func TestWriteStateDocumentRecordsPrevious(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	first := storeGeneration(t, e, stateJSON("lineage", 1))
+	second := storeGeneration(t, e, stateJSON("lineage", 2))
+
+	// Each version records the version it replaced, which isn't part of the served state.
+	source, err := e.getStateDocument(second)
+	if err != nil || source == nil || source["previous"] != first {
+		t.Fatalf("expected version %s to record %s as previous, got %v (%v)", second, first, source["previous"], err)
+	}
+	if source, _ := e.getStateDocument(first); source["previous"] != nil {
+		t.Fatalf("expected the first version to have no previous version, got %v", source["previous"])
+	}
+	stripInternalFields(source)
+	if _, ok := source["previous"]; ok {
+		t.Fatal("expected the previous version to be an internal field")
+	}
+}
+
+func TestDeleteVersionKeepsResourcesOfSharedTimestamp(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// Two versions without a generation were written within the same second.
+	const timestamp = "2024-01-01T00:00:00Z"
+	for _, id := range []string{"first", "second"} {
+		cluster.put("terraform-state", id, map[string]interface{}{
+			"project": "app", "workspace": DefaultWorkspace, "committed": true, "timestamp": timestamp,
+		})
+		cluster.put("terraform-resources", "", map[string]interface{}{
+			"project": "app", "workspace": DefaultWorkspace, "timestamp": timestamp, "position": 0,
+		})
+	}
+
+	// The resources can't be told apart, so they are kept with the first version.
+	if err := e.deleteVersion("first", "", timestamp); err != nil {
+		t.Fatalf("deleteVersion failed: %s", err)
+	}
+	if source, err := e.getStateDocument("first"); err != nil || source != nil {
+		t.Fatalf("expected the state document to be removed, got %v (%v)", source, err)
+	}
+	if resources := cluster.documents("terraform-resources"); len(resources) != 2 {
+		t.Fatalf("expected the resources to be kept, got %d", len(resources))
+	}
+
+	// They are removed with the last version of the timestamp.
+	if err := e.deleteVersion("second", "", timestamp); err != nil {
+		t.Fatalf("deleteVersion failed: %s", err)
+	}
+	if resources := cluster.documents("terraform-resources"); len(resources) != 0 {
+		t.Fatalf("expected the resources to be removed, got %d", len(resources))
+	}
+}
+
+func TestListWorkspaces(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	if workspaces, err := e.ListWorkspaces(); err != nil || len(workspaces) != 0 {
+		t.Fatalf("expected no workspaces without an index, got %v (%v)", workspaces, err)
+	}
+
+	for _, pointer := range []struct{ project, workspace string }{
+		{"app", "staging"}, {"app", DefaultWorkspace}, {"other", "production"},
+	} {
+		cluster.put("terraform-state-pointers", "", map[string]interface{}{
+			"project": pointer.project, "workspace": pointer.workspace, "generation": "generation",
+		})
+	}
+
+	// Only the workspaces of the project are listed, whatever the workspace of the client.
+	workspaces, err := e.ListWorkspaces()
+	if err != nil {
+		t.Fatalf("ListWorkspaces failed: %s", err)
+	}
+	if len(workspaces) != 2 || workspaces[0] != DefaultWorkspace || workspaces[1] != "staging" {
+		t.Fatalf("expected the workspaces of the project, got %v", workspaces)
+	}
+}
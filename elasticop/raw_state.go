@@ -0,0 +1,109 @@
+package elasticop
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+	"go.uber.org/zap"
+)
+
+// rawStateField is the field of the state document holding the state exactly as Terraform posted it.
+const rawStateField = "raw_state"
+
+// rawStateMappings defines the mapping of the raw state, which is stored, but not indexed.
+var rawStateMappings = map[string]interface{}{"type": "object", "enabled": false}
+
+// encodeRawState compresses the raw state, and encrypts it with Vault if the raw state must be encrypted.
+// The raw state is always encrypted when fields of the state are encrypted, so it doesn't expose them.
+// It returns the value of the raw state field of the state document.
+func (e *Elastic) encodeRawState(raw []byte) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+
+	// Compress the raw state.
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(raw); err != nil {
+		e.Logger.Error("Error compressing the raw state", zap.Error(err))
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		e.Logger.Error("Error compressing the raw state", zap.Error(err))
+		return nil, err
+	}
+
+	encrypted := e.RawStateEncrypted()
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+	if encrypted {
+		// Encrypt the compressed state.
+		encryptedVal, err := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault).EncryptWithVault(buf.String(), e.Project)
+		if err != nil {
+			e.Logger.Error("Failed to encrypt the raw state using vault", zap.Error(err))
+			return nil, err
+		}
+		data = "tfb_" + encryptedVal
+	}
+
+	return map[string]interface{}{
+		"encoding":  "gzip",
+		"encrypted": encrypted,
+		"data":      data,
+	}, nil
+}
+
+// RawStateEncrypted reports whether the raw state is encrypted in the project. It is encrypted if configured,
+// and whenever fields of the state are encrypted, so it doesn't expose them.
+func (e *Elastic) RawStateEncrypted() bool {
+	return e.EncryptRawState || e.EncryptSensitive || len(e.Encrypt) > 0
+}
+
+// decodeRawState returns the raw state stored in the state document, decrypting and decompressing it.
+// It returns nil without an error if the state document has no raw state, like states stored before
+// the raw state was introduced.
+func (e *Elastic) decodeRawState(source map[string]interface{}) ([]byte, error) {
+	rawState, ok := source[rawStateField].(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	data, _ := rawState["data"].(string)
+
+	var compressed []byte
+	if encrypted, _ := rawState["encrypted"].(bool); encrypted {
+		// Decrypt the compressed state.
+		decryptedVal, err := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault).DecryptWithVault(strings.TrimPrefix(data, "tfb_"), e.Project)
+		if err != nil {
+			e.Logger.Error("Failed to decrypt the raw state using vault", zap.Error(err))
+			return nil, err
+		}
+		compressed = []byte(decryptedVal)
+	} else {
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			e.Logger.Error("Failed to decode the raw state", zap.Error(err))
+			return nil, err
+		}
+		compressed = decoded
+	}
+
+	if encoding, _ := rawState["encoding"].(string); encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported raw state encoding %q", encoding)
+	}
+
+	// Decompress the state.
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		e.Logger.Error("Failed to decompress the raw state", zap.Error(err))
+		return nil, err
+	}
+	defer reader.Close()
+
+	raw, err := io.ReadAll(reader)
+	if err != nil {
+		e.Logger.Error("Failed to decompress the raw state", zap.Error(err))
+		return nil, err
+	}
+	return raw, nil
+}
@@ -0,0 +1,77 @@
+package elasticop
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRawStateRoundTrip(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	transit := withFakeTransit(t, e)
+	raw := []byte(`{"version": 4, "serial": 1, "outputs": {"password": {"value": "secret", "sensitive": true}}}`)
+
+	for _, encrypted := range []bool{false, true} {
+		e.EncryptRawState = encrypted
+
+		// The raw state is compressed, and only readable through Vault when encrypted.
+		encoded, err := e.encodeRawState(raw)
+		if err != nil {
+			t.Fatalf("encodeRawState failed: %s", err)
+		}
+		data, _ := encoded["data"].(string)
+		if encoded["encoding"] != "gzip" || encoded["encrypted"] != encrypted {
+			t.Fatalf("unexpected encoding of the raw state %v", encoded)
+		}
+		if strings.HasPrefix(data, "tfb_"+fakeTransitPrefix) != encrypted {
+			t.Fatalf("expected the raw state to be encrypted: %t, got %q", encrypted, data)
+		}
+
+		// Decoding returns the state exactly as it was posted.
+		decoded, err := e.decodeRawState(map[string]interface{}{rawStateField: encoded})
+		if err != nil {
+			t.Fatalf("decodeRawState failed: %s", err)
+		}
+		if !bytes.Equal(decoded, raw) {
+			t.Fatalf("expected the raw state to round trip, got %s", decoded)
+		}
+
+		// A raw state written with another setting is still decoded.
+		e.EncryptRawState = !encrypted
+		if decoded, err := e.decodeRawState(map[string]interface{}{rawStateField: encoded}); err != nil || !bytes.Equal(decoded, raw) {
+			t.Fatalf("expected the raw state to be decoded regardless of the setting, got %s (%v)", decoded, err)
+		}
+	}
+
+	// A failure to decrypt the raw state is reported.
+	e.EncryptRawState = true
+	encoded, err := e.encodeRawState(raw)
+	if err != nil {
+		t.Fatalf("encodeRawState failed: %s", err)
+	}
+	transit.fail(fakePlaintext(t, strings.TrimPrefix(encoded["data"].(string), "tfb_")))
+	if _, err := e.decodeRawState(map[string]interface{}{rawStateField: encoded}); err == nil {
+		t.Fatal("expected the failure to decrypt the raw state to be reported")
+	}
+}
+
+func TestDecodeRawStateWithoutRawState(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// States stored before the raw state was introduced have none.
+	if decoded, err := e.decodeRawState(map[string]interface{}{"serial": 1}); err != nil || decoded != nil {
+		t.Fatalf("expected no raw state, got %s (%v)", decoded, err)
+	}
+
+	// Unknown encodings are rejected.
+	encoded, err := e.encodeRawState([]byte("{}"))
+	if err != nil {
+		t.Fatalf("encodeRawState failed: %s", err)
+	}
+	encoded["encoding"] = "zstd"
+	if _, err := e.decodeRawState(map[string]interface{}{rawStateField: encoded}); err == nil {
+		t.Fatal("expected an unsupported encoding to be rejected")
+	}
+}
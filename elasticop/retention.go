@@ -0,0 +1,199 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// versionPageSize is the number of versions fetched from Elasticsearch per request when pruning.
+const versionPageSize = 1000
+
+// versionDocument is a committed version of the state as considered for pruning.
+type versionDocument struct {
+	ID         string
+	Generation string
+	Timestamp  string
+}
+
+// RetentionEnabled reports whether a retention policy is configured for the project.
+func (e *Elastic) RetentionEnabled() bool {
+	return e.RetentionKeepVersions > 0 || e.RetentionKeepDays > 0
+}
+
+// PruneVersions removes the versions of the state which are not kept by the retention policy of the project.
+// A version is kept if it is one of the latest RetentionKeepVersions versions, if it is younger than
+// RetentionKeepDays days, if it is the first version of its day and RetentionKeepDaily is set,
+// or if it is the current version. With dryRun, the versions are only returned, not removed.
+// It returns the versions which were, or would be, removed.
+func (e *Elastic) PruneVersions(dryRun bool) ([]StateVersion, error) {
+	if !e.RetentionEnabled() {
+		return []StateVersion{}, nil
+	}
+
+	pointer, err := e.getPointer()
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := e.committedVersions()
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the first version of each day.
+	firstOfDay := map[string]string{}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if day := versionDay(versions[i].Timestamp); day != "" {
+			if _, ok := firstOfDay[day]; !ok {
+				firstOfDay[day] = versions[i].ID
+			}
+		}
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -e.RetentionKeepDays)
+	pruned := []StateVersion{}
+	for i, version := range versions {
+		// The latest versions and the current version are always kept.
+		if i < e.RetentionKeepVersions || i == 0 || (pointer != nil && version.ID == pointer.Generation) {
+			continue
+		}
+
+		// Versions younger than the retention period are kept.
+		timestamp, err := time.Parse(time.RFC3339, version.Timestamp)
+		if err != nil || !timestamp.Before(cutoff) {
+			continue
+		}
+
+		// The first version of each day is kept, if configured.
+		if e.RetentionKeepDaily && firstOfDay[versionDay(version.Timestamp)] == version.ID {
+			continue
+		}
+
+		pruned = append(pruned, StateVersion{ID: version.ID, Timestamp: version.Timestamp})
+		if dryRun {
+			continue
+		}
+		if err := e.deleteVersion(version.ID, version.Generation, version.Timestamp); err != nil {
+			return pruned, err
+		}
+	}
+
+	e.Logger.Info("Pruned state versions", zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.Int("versions", len(pruned)), zap.Bool("dry_run", dryRun))
+	return pruned, nil
+}
+
+// versionDay returns the UTC date of the timestamp, or an empty string if it can't be parsed.
+func versionDay(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return ""
+	}
+	return t.UTC().Format("2006-01-02")
+}
+
+// committedVersions retrieves all committed versions of the state, newest first.
+// The versions are paged through with a point in time, so concurrent writes don't shift the pages.
+func (e *Elastic) committedVersions() ([]versionDocument, error) {
+	// Open a point in time, so the pages are consistent with each other.
+	pitID, err := e.openPointInTime(e.StateIndex)
+	if err != nil {
+		return nil, err
+	}
+	if pitID == "" {
+		// The state index doesn't exist yet.
+		return nil, nil
+	}
+	defer func() { e.closePointInTime(pitID) }()
+
+	var versions []versionDocument
+	var searchAfter []interface{}
+	for {
+		var buf bytes.Buffer
+
+		// Define Elasticsearch query to fetch the next page of versions, newest first.
+		query := map[string]interface{}{
+			"query":   e.committedQuery(),
+			"size":    versionPageSize,
+			"_source": []string{"generation", "timestamp"},
+			"pit": map[string]interface{}{
+				"id":         pitID,
+				"keep_alive": pointInTimeKeepAlive,
+			},
+			"sort": []map[string]interface{}{
+				{"timestamp": map[string]interface{}{"order": "desc"}},
+				{"_shard_doc": map[string]interface{}{"order": "desc"}},
+			},
+		}
+		if searchAfter != nil {
+			query["search_after"] = searchAfter
+		}
+
+		// Encode the Elasticsearch query
+		if err := json.NewEncoder(&buf).Encode(query); err != nil {
+			e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+			return nil, err
+		}
+
+		// Search for the versions in Elasticsearch
+		res, err := e.Client.Search(
+			e.Client.Search.WithContext(e.Ctx),
+			e.Client.Search.WithBody(&buf),
+		)
+		if err != nil {
+			e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+			return nil, err
+		}
+
+		// Parse response from Elasticsearch
+		var r struct {
+			PitID string `json:"pit_id"`
+			Hits  struct {
+				Hits []struct {
+					ID     string `json:"_id"`
+					Source struct {
+						Generation string `json:"generation"`
+						Timestamp  string `json:"timestamp"`
+					} `json:"_source"`
+					Sort []interface{} `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		decoder := json.NewDecoder(res.Body)
+		decoder.UseNumber()
+		err = decoder.Decode(&r)
+		res.Body.Close()
+		if res.IsError() {
+			e.Logger.Error("Error searching the versions", zap.Int("status_code", res.StatusCode))
+			return nil, fmt.Errorf("error searching versions: %s", res.Status())
+		}
+		if err != nil {
+			e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+			return nil, err
+		}
+
+		// The point in time ID may change between pages.
+		if r.PitID != "" {
+			pitID = r.PitID
+		}
+
+		for _, hit := range r.Hits.Hits {
+			versions = append(versions, versionDocument{
+				ID:         hit.ID,
+				Generation: hit.Source.Generation,
+				Timestamp:  hit.Source.Timestamp,
+			})
+			searchAfter = hit.Sort
+		}
+
+		// The last page is shorter than the page size.
+		if len(r.Hits.Hits) < versionPageSize {
+			break
+		}
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,45 @@
+package elasticop
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCommittedVersionsPagesNewestFirst(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// Store committed versions across several pages, and uncommitted versions which must be skipped.
+	const total = 2*versionPageSize + 300
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < total; i++ {
+		generation := "generation-" + strconv.Itoa(i)
+		cluster.put("terraform-state", generation, map[string]interface{}{
+			"project": "app", "workspace": DefaultWorkspace, "generation": generation, "committed": true,
+			"timestamp": base.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+		})
+		if i%50 == 0 {
+			cluster.put("terraform-state", "uncommitted-"+strconv.Itoa(i), map[string]interface{}{
+				"project": "app", "workspace": DefaultWorkspace, "committed": false,
+				"timestamp": base.Add(time.Duration(i) * time.Minute).Format(time.RFC3339),
+			})
+		}
+	}
+
+	versions, err := e.committedVersions()
+	if err != nil {
+		t.Fatalf("committedVersions failed: %s", err)
+	}
+	if len(versions) != total {
+		t.Fatalf("expected %d versions, got %d", total, len(versions))
+	}
+	for i, version := range versions {
+		if expected := "generation-" + strconv.Itoa(total-1-i); version.Generation != expected {
+			t.Fatalf("expected %s at position %d, got %s", expected, i, version.Generation)
+		}
+	}
+	if cluster.stalePIT != 0 || cluster.openPITs() != 0 {
+		t.Fatalf("expected the latest point in time to be used and closed, got %d stale searches and %d open", cluster.stalePIT, cluster.openPITs())
+	}
+}
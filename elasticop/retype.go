@@ -0,0 +1,282 @@
+package elasticop
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+	"go.uber.org/zap"
+)
+
+// RetypeResult reports the conversion of the values encrypted in the legacy envelope.
+type RetypeResult struct {
+	// Documents is the number of documents checked, and Updated the number of documents written back.
+	Documents int `json:"documents"`
+	Updated   int `json:"updated"`
+
+	// Values is the number of values converted, of which Strings were stored as strings.
+	Values  int `json:"values"`
+	Strings int `json:"strings"`
+
+	// Conflicts is the number of documents changed concurrently, and Failed the number of documents
+	// which couldn't be converted or written. They are left as they were, and converted by the next run.
+	Conflicts int `json:"conflicts"`
+	Failed    int `json:"failed"`
+}
+
+// ProviderSchemas holds the types of the resource attributes declared by the provider schemas, as printed
+// by `terraform providers schema -json`, keyed by resource mode and type, then by attribute name.
+type ProviderSchemas map[string]map[string]interface{}
+
+// ParseProviderSchemas reads the types of the top-level attributes of the resources and data sources from
+// the JSON output of `terraform providers schema -json`.
+func ParseProviderSchemas(data []byte) (ProviderSchemas, error) {
+	type blockSchema struct {
+		Block struct {
+			Attributes map[string]struct {
+				Type interface{} `json:"type"`
+			} `json:"attributes"`
+		} `json:"block"`
+	}
+	var parsed struct {
+		ProviderSchemas map[string]struct {
+			ResourceSchemas   map[string]blockSchema `json:"resource_schemas"`
+			DataSourceSchemas map[string]blockSchema `json:"data_source_schemas"`
+		} `json:"provider_schemas"`
+	}
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("error parsing provider schemas: %s", err)
+	}
+
+	schemas := ProviderSchemas{}
+	add := func(mode string, blocks map[string]blockSchema) {
+		for name, block := range blocks {
+			types := map[string]interface{}{}
+			for attribute, schema := range block.Block.Attributes {
+				types[attribute] = schema.Type
+			}
+			schemas[mode+"."+name] = types
+		}
+	}
+	for _, provider := range parsed.ProviderSchemas {
+		add("managed", provider.ResourceSchemas)
+		add("data", provider.DataSourceSchemas)
+	}
+	return schemas, nil
+}
+
+// attributeType returns the type of the attribute of the resource, or nil if it isn't known.
+func (s ProviderSchemas) attributeType(mode, resourceType, attribute string) interface{} {
+	return s[mode+"."+resourceType][attribute]
+}
+
+// retypeJob is a value in the legacy envelope to convert.
+type retypeJob struct {
+	document   int
+	ciphertext string
+
+	// typ is the type of the value declared by the provider schema or recorded with the output, or nil
+	// if it isn't known.
+	typ interface{}
+
+	// value is the decrypted value with its JSON type restored.
+	value interface{}
+
+	// set stores the converted value in place of the value.
+	set func(interface{})
+}
+
+// RetypeLegacyValues converts the values of every state and resource document of the project, in all
+// workspaces and versions, which were encrypted before the JSON type of values was recorded. Each value is
+// decrypted, and encrypted again in the typed envelope. The legacy string doesn't tell a number from a string
+// of digits, so the type is only restored for the outputs, whose type is recorded in the state, and for the
+// top-level resource attributes declared as numbers or booleans by the provider schemas, if given. Any other
+// value is kept as a string, and so are objects and arrays, which were formatted irrecoverably. Documents
+// without legacy values are left untouched, so an interrupted conversion is resumed by running it again.
+func (e *Elastic) RetypeLegacyValues(schemas ProviderSchemas) (*RetypeResult, error) {
+	vault := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault)
+
+	result := &RetypeResult{}
+	for _, index := range []string{e.StateIndex, e.ResourceIndex} {
+		err := e.updateDocumentPages(index, func(documents []*rewrapDocument) (int, error) {
+			return e.retypeDocuments(vault, index, documents, schemas, result)
+		})
+		if err != nil {
+			return result, err
+		}
+	}
+
+	e.Logger.Info("Legacy encrypted values converted", zap.String("project", e.Project), zap.Int("documents", result.Documents),
+		zap.Int("updated", result.Updated), zap.Int("values", result.Values), zap.Int("strings", result.Strings),
+		zap.Int("conflicts", result.Conflicts), zap.Int("failed", result.Failed))
+	return result, nil
+}
+
+// retypeDocuments converts the legacy values of the documents with Vault in batches, and writes the changed
+// documents back, provided they weren't changed since they were read. It returns the number of documents written.
+func (e *Elastic) retypeDocuments(vault *vaultop.Vault, index string, documents []*rewrapDocument, schemas ProviderSchemas, result *RetypeResult) (int, error) {
+	result.Documents += len(documents)
+
+	// Collect the values in the legacy envelope. The encrypted raw state uses the same prefix, but holds
+	// the compressed state rather than a value, so it is left alone.
+	var jobs []*retypeJob
+	for i, document := range documents {
+		typeOf := legacyTypes(document.Source, schemas)
+		for key, val := range document.Source {
+			if key != rawStateField {
+				collectRetypeJobs(val, []string{key}, i, typeOf, &jobs)
+			}
+		}
+	}
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	// Decrypt the legacy values and restore their type.
+	ciphertexts := make([]string, len(jobs))
+	for i, job := range jobs {
+		ciphertexts[i] = job.ciphertext
+	}
+	decrypted, err := vault.DecryptBatchWithVault(ciphertexts, e.Project)
+	if err != nil {
+		return 0, err
+	}
+
+	var encrypt []*retypeJob
+	var inputs []string
+	for i, job := range jobs {
+		if decrypted[i].Err != nil {
+			e.Logger.Error("Failed to decrypt legacy value", zap.String("index", index), zap.String("id", documents[job.document].ID), zap.Error(decrypted[i].Err))
+			documents[job.document].Failed = true
+			continue
+		}
+		job.value = legacyValue(decrypted[i].Value, job.typ)
+
+		encoded, err := json.Marshal(job.value)
+		if err != nil {
+			return 0, err
+		}
+		encrypt = append(encrypt, job)
+		inputs = append(inputs, string(encoded))
+	}
+
+	// Encrypt the values again in the typed envelope. Documents with a value which couldn't be converted
+	// are left as they were.
+	encrypted, err := vault.EncryptBatchWithVault(inputs, e.Project)
+	if err != nil {
+		return 0, err
+	}
+	changed := map[int]int{}
+	texts := map[int]int{}
+	for i, job := range encrypt {
+		if encrypted[i].Err != nil {
+			e.Logger.Error("Failed to encrypt converted value", zap.String("index", index), zap.String("id", documents[job.document].ID), zap.Error(encrypted[i].Err))
+			documents[job.document].Failed = true
+			continue
+		}
+		typ := jsonType(job.value)
+		job.set(encryptedPrefix + typ + ":" + encrypted[i].Value)
+		changed[job.document]++
+		if typ == "string" {
+			texts[job.document]++
+		}
+	}
+
+	written, err := e.writeDocuments(index, documents, changed)
+	if err != nil {
+		return 0, err
+	}
+	result.Updated += written.updated
+	result.Values += written.values
+	result.Conflicts += written.conflicts
+	result.Failed += written.failed
+	for document, count := range texts {
+		if !documents[document].Failed {
+			result.Strings += count
+		}
+	}
+	return written.updated, nil
+}
+
+// legacyTypes returns a function resolving the type of the value at a path of the document: the type recorded
+// with an output of a state document, or the type of a top-level attribute of a resource instance declared by
+// the provider schemas. It returns nil for any other value.
+func legacyTypes(source map[string]interface{}, schemas ProviderSchemas) func(path []string) interface{} {
+	mode, _ := source["mode"].(string)
+	resourceType, _ := source["type"].(string)
+	outputs, _ := source["outputs"].(map[string]interface{})
+
+	return func(path []string) interface{} {
+		switch {
+		case len(path) == 3 && path[0] == "outputs" && path[2] == "value":
+			output, _ := outputs[path[1]].(map[string]interface{})
+			return output["type"]
+		case len(path) == 4 && path[0] == "instances" && path[2] == "attributes":
+			return schemas.attributeType(mode, resourceType, path[3])
+		}
+		return nil
+	}
+}
+
+// collectRetypeJobs adds the values in the node at the path which are encrypted in the legacy envelope,
+// with their type resolved by typeOf.
+func collectRetypeJobs(node interface{}, path []string, document int, typeOf func(path []string) interface{}, jobs *[]*retypeJob) {
+	add := func(s string, path []string, set func(interface{})) {
+		*jobs = append(*jobs, &retypeJob{document: document, ciphertext: strings.TrimPrefix(s, encryptedPrefix),
+			typ: typeOf(path), set: set})
+	}
+
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			childPath := append(path[:len(path):len(path)], k)
+			if s, ok := val.(string); ok && strings.HasPrefix(s, legacyEncryptedPrefix) {
+				add(s, childPath, func(value interface{}) { v[k] = value })
+				continue
+			}
+			collectRetypeJobs(val, childPath, document, typeOf, jobs)
+		}
+	case []interface{}:
+		for i, val := range v {
+			childPath := append(path[:len(path):len(path)], strconv.Itoa(i))
+			if s, ok := val.(string); ok && strings.HasPrefix(s, legacyEncryptedPrefix) {
+				add(s, childPath, func(value interface{}) { v[i] = value })
+				continue
+			}
+			collectRetypeJobs(val, childPath, document, typeOf, jobs)
+		}
+	}
+}
+
+// legacyValue restores the JSON type of a value decrypted from the legacy envelope, which holds the value
+// formatted as a string, given the type it is known to have. Values of a known number or boolean type are
+// restored, including nulls, which were formatted as <nil>. Any other value is kept as a string, as the
+// string alone doesn't tell whether "42" or "true" were strings.
+func legacyValue(s string, typ interface{}) interface{} {
+	if (typ == "number" || typ == "bool") && s == "<nil>" {
+		return nil
+	}
+
+	switch typ {
+	case "bool":
+		switch s {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+	case "number":
+		// Numbers were formatted like 42 or 1e+06, which are valid JSON numbers.
+		var val interface{}
+		decoder := json.NewDecoder(strings.NewReader(s))
+		decoder.UseNumber()
+		if err := decoder.Decode(&val); err == nil && !decoder.More() {
+			if number, ok := val.(json.Number); ok && number.String() == s {
+				return number
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,241 @@
+package elasticop
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// legacyEncrypted returns a value encrypted in the legacy envelope by the fake Transit backend.
+func legacyEncrypted(text string) string {
+	return "tfb_" + fakeCiphertext(text)
+}
+
+// testSchemas are the provider schemas of the resources of the tests, as printed by terraform providers schema -json.
+const testSchemas = `{"format_version": "1.0", "provider_schemas": {"registry.terraform.io/example/app": {
+	"resource_schemas": {"app_server": {"version": 0, "block": {"attributes": {
+		"port": {"type": "number"}, "ratio": {"type": "number"}, "enabled": {"type": "bool"}, "owner": {"type": "number"},
+		"name": {"type": "string"}, "version": {"type": "string"}, "tags": {"type": ["map", "string"]},
+		"zones": {"type": ["list", "string"]}}}}},
+	"data_source_schemas": {"app_server": {"version": 0, "block": {"attributes": {"port": {"type": "string"}}}}}}}}`
+
+// resourceAttributes returns the attributes of the single instance of the resource document.
+func resourceAttributes(t *testing.T, cluster *fakeCluster, id string) map[string]interface{} {
+	t.Helper()
+	instances := documentSource(t, cluster, "terraform-resources", id)["instances"].([]interface{})
+	return instances[0].(map[string]interface{})["attributes"].(map[string]interface{})
+}
+
+func TestRetypeLegacyValues(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	transit := withFakeTransit(t, e)
+	schemas, err := ParseProviderSchemas([]byte(testSchemas))
+	if err != nil {
+		t.Fatalf("ParseProviderSchemas failed: %s", err)
+	}
+
+	typed := "tfb_string:" + fakeCiphertext(`"typed"`)
+	rawState := map[string]interface{}{"encrypted": true, "data": legacyEncrypted("compressed")}
+	cluster.put("terraform-state", "current", map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "raw_state": rawState,
+		"outputs": map[string]interface{}{
+			"port":  map[string]interface{}{"value": legacyEncrypted("8080"), "type": "number"},
+			"label": map[string]interface{}{"value": legacyEncrypted("true"), "type": "string"},
+		},
+	})
+	cluster.put("terraform-resources", "instance", map[string]interface{}{
+		"project": "app", "workspace": "staging", "mode": "managed", "type": "app_server",
+		"instances": []interface{}{map[string]interface{}{"attributes": map[string]interface{}{
+			"port":    legacyEncrypted("8080"),
+			"ratio":   legacyEncrypted("1e+06"),
+			"enabled": legacyEncrypted("false"),
+			"owner":   legacyEncrypted("<nil>"),
+			"name":    legacyEncrypted("web"),
+			"version": legacyEncrypted("42"),
+			"unknown": legacyEncrypted("true"),
+			"tags":    legacyEncrypted("map[env:prod]"),
+			"zones":   []interface{}{legacyEncrypted("42"), "plain"},
+			"typed":   typed,
+			"plain":   "8080",
+		}}},
+	})
+	cluster.put("terraform-resources", "failing", map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "mode": "managed", "type": "app_server",
+		"instances": []interface{}{map[string]interface{}{"attributes": map[string]interface{}{
+			"port": legacyEncrypted("1"), "name": legacyEncrypted("broken"),
+		}}},
+	})
+	cluster.put("terraform-resources", "other", map[string]interface{}{
+		"project": "other", "workspace": DefaultWorkspace, "mode": "managed", "type": "app_server",
+		"instances": []interface{}{map[string]interface{}{"attributes": map[string]interface{}{"port": legacyEncrypted("8080")}}},
+	})
+	transit.fail("broken")
+
+	result, err := e.RetypeLegacyValues(schemas)
+	if err != nil {
+		t.Fatalf("RetypeLegacyValues failed: %s", err)
+	}
+	if result.Documents != 3 || result.Updated != 2 || result.Values != 11 || result.Strings != 6 || result.Failed != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	// The values of a known type get the envelope of their type, with the JSON encoding of the value as
+	// plaintext, while the values of strings or of an unknown type are kept as strings.
+	attributes := resourceAttributes(t, cluster, "instance")
+	expected := map[string]string{
+		"port":    "tfb_number:" + fakeCiphertext("8080"),
+		"ratio":   "tfb_number:" + fakeCiphertext("1e+06"),
+		"enabled": "tfb_bool:" + fakeCiphertext("false"),
+		"owner":   "tfb_null:" + fakeCiphertext("null"),
+		"name":    "tfb_string:" + fakeCiphertext(`"web"`),
+		"version": "tfb_string:" + fakeCiphertext(`"42"`),
+		"unknown": "tfb_string:" + fakeCiphertext(`"true"`),
+		"tags":    "tfb_string:" + fakeCiphertext(`"map[env:prod]"`),
+		"typed":   typed,
+		"plain":   "8080",
+	}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("expected %s to be %s, got %v", key, value, attributes[key])
+		}
+	}
+	zones := attributes["zones"].([]interface{})
+	if zones[0] != "tfb_string:"+fakeCiphertext(`"42"`) || zones[1] != "plain" {
+		t.Errorf("unexpected list values %v", zones)
+	}
+
+	// The encrypted raw state is left alone, while the outputs are converted to the type recorded in the state.
+	state := documentSource(t, cluster, "terraform-state", "current")
+	if data := state["raw_state"].(map[string]interface{})["data"]; data != legacyEncrypted("compressed") {
+		t.Errorf("expected the raw state to be left alone, got %v", data)
+	}
+	outputs := state["outputs"].(map[string]interface{})
+	if port := outputs["port"].(map[string]interface{})["value"]; port != "tfb_number:"+fakeCiphertext("8080") {
+		t.Errorf("expected the output to be converted to a number, got %v", port)
+	}
+	if label := outputs["label"].(map[string]interface{})["value"]; label != "tfb_string:"+fakeCiphertext(`"true"`) {
+		t.Errorf("expected the string output to be kept as a string, got %v", label)
+	}
+
+	// A document with a value which couldn't be converted is left as it was, and so are other projects.
+	if failing := resourceAttributes(t, cluster, "failing"); failing["port"] != legacyEncrypted("1") {
+		t.Errorf("expected the failed document to be left as it was, got %v", failing["port"])
+	}
+	if other := resourceAttributes(t, cluster, "other"); other["port"] != legacyEncrypted("8080") {
+		t.Errorf("expected the other project to be left alone, got %v", other["port"])
+	}
+
+	// Converted values are decrypted to their original type.
+	decrypted := map[string]interface{}{}
+	for key, value := range attributes {
+		decrypted[key] = value
+	}
+	if err := e.TraverseAndModify(decrypted, nil, false); err != nil {
+		t.Fatalf("TraverseAndModify failed: %s", err)
+	}
+	if decrypted["port"] != json.Number("8080") || decrypted["enabled"] != false || decrypted["owner"] != nil ||
+		decrypted["name"] != "web" || decrypted["version"] != "42" {
+		t.Errorf("unexpected decrypted values %v", decrypted)
+	}
+
+	// Running it again only retries the failed document.
+	transit.mu.Lock()
+	transit.failing = map[string]bool{}
+	transit.mu.Unlock()
+	result, err = e.RetypeLegacyValues(schemas)
+	if err != nil {
+		t.Fatalf("RetypeLegacyValues failed: %s", err)
+	}
+	if result.Updated != 1 || result.Values != 2 || result.Strings != 1 || result.Failed != 0 {
+		t.Fatalf("unexpected result of the second run %+v", result)
+	}
+}
+
+func TestRetypeLegacyValuesWithoutSchemas(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	withFakeTransit(t, e)
+	cluster.put("terraform-resources", "instance", map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "mode": "managed", "type": "app_server",
+		"instances": []interface{}{map[string]interface{}{"attributes": map[string]interface{}{"port": legacyEncrypted("8080")}}},
+	})
+
+	// Without the provider schemas, the type of the attributes isn't known, so they are kept as strings.
+	result, err := e.RetypeLegacyValues(nil)
+	if err != nil {
+		t.Fatalf("RetypeLegacyValues failed: %s", err)
+	}
+	if result.Values != 1 || result.Strings != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if port := resourceAttributes(t, cluster, "instance")["port"]; port != "tfb_string:"+fakeCiphertext(`"8080"`) {
+		t.Errorf("expected the attribute to be kept as a string, got %v", port)
+	}
+}
+
+func TestParseProviderSchemas(t *testing.T) {
+	schemas, err := ParseProviderSchemas([]byte(testSchemas))
+	if err != nil {
+		t.Fatalf("ParseProviderSchemas failed: %s", err)
+	}
+	if typ := schemas.attributeType("managed", "app_server", "port"); typ != "number" {
+		t.Errorf("expected the resource attribute to be a number, got %v", typ)
+	}
+	if typ := schemas.attributeType("data", "app_server", "port"); typ != "string" {
+		t.Errorf("expected the data source attribute to be a string, got %v", typ)
+	}
+	if typ := schemas.attributeType("managed", "app_client", "port"); typ != nil {
+		t.Errorf("expected the attribute of an unknown resource to have no type, got %v", typ)
+	}
+	if _, err := ParseProviderSchemas([]byte("not json")); err == nil {
+		t.Error("expected invalid provider schemas to be rejected")
+	}
+}
+
+func TestLegacyValue(t *testing.T) {
+	tests := []struct {
+		input    string
+		typ      interface{}
+		expected interface{}
+	}{
+		{"42", "number", json.Number("42")},
+		{"-1.5", "number", json.Number("-1.5")},
+		{"1e+06", "number", json.Number("1e+06")},
+		{"<nil>", "number", nil},
+		{" 42", "number", " 42"},
+		{"42 43", "number", "42 43"},
+		{"0x10", "number", "0x10"},
+		{"true", "bool", true},
+		{"false", "bool", false},
+		{"<nil>", "bool", nil},
+		{"yes", "bool", "yes"},
+		{"42", "string", "42"},
+		{"true", "string", "true"},
+		{"<nil>", "string", "<nil>"},
+		{"42", nil, "42"},
+		{"true", nil, "true"},
+		{"<nil>", nil, "<nil>"},
+		{"", nil, ""},
+		{"[a b]", []interface{}{"list", "string"}, "[a b]"},
+		{"map[a:b]", nil, "map[a:b]"},
+		{`"quoted"`, nil, `"quoted"`},
+		{"web-server-01", "string", "web-server-01"},
+	}
+	for _, test := range tests {
+		if actual := legacyValue(test.input, test.typ); actual != test.expected {
+			t.Errorf("legacyValue(%q, %v) = %#v, expected %#v", test.input, test.typ, actual, test.expected)
+		}
+	}
+}
+
+// documentSource returns the source of the document stored in the fake cluster.
+func documentSource(t *testing.T, cluster *fakeCluster, index, id string) map[string]interface{} {
+	t.Helper()
+	for _, doc := range cluster.documents(index) {
+		if doc.id == id {
+			return doc.source
+		}
+	}
+	t.Fatalf("document %s not found in %s", id, index)
+	return nil
+}
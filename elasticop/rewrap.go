@@ -0,0 +1,393 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+	"go.uber.org/zap"
+)
+
+// rewrapPageSize is the number of documents rewrapped and written back at once.
+const rewrapPageSize = 100
+
+// ciphertextVersion matches the key version of a Transit ciphertext, like vault:v2:...
+var ciphertextVersion = regexp.MustCompile(`^vault:v(\d+):`)
+
+// RewrapProgress reports the progress of a rewrap of the project.
+type RewrapProgress struct {
+	// Index is the index currently being rewrapped.
+	Index string `json:"index"`
+
+	// KeyVersion is the latest version of the Transit key of the project, which the values are rewrapped to.
+	KeyVersion int `json:"keyVersion"`
+
+	// Documents is the number of documents checked, and Updated the number of documents written back.
+	Documents int `json:"documents"`
+	Updated   int `json:"updated"`
+
+	// Values is the number of encrypted values rewrapped.
+	Values int `json:"values"`
+
+	// Conflicts is the number of documents changed concurrently, and Failed the number of documents
+	// which couldn't be rewrapped or written. They are left as they were, and rewrapped by the next run.
+	Conflicts int `json:"conflicts"`
+	Failed    int `json:"failed"`
+}
+
+// rewrapJob is an encrypted value of a document to rewrap.
+type rewrapJob struct {
+	document int
+
+	// prefix is the envelope of the value, like tfb_string:, and ciphertext the Transit ciphertext.
+	prefix     string
+	ciphertext string
+
+	// set stores the rewrapped value in place of the value.
+	set func(interface{})
+}
+
+// rewrapDocument is a document of the project read for rewrapping.
+type rewrapDocument struct {
+	ID          string
+	SeqNo       int64
+	PrimaryTerm int64
+	Source      map[string]interface{}
+	Failed      bool
+}
+
+// RewrapProject rewraps the encrypted values of every state and resource document of the project, in all
+// workspaces and versions, with the latest version of the project's Transit key, and writes the documents
+// back in place. Values already encrypted with the latest key version are skipped, and documents without
+// values to rewrap are left untouched, so an interrupted rewrap is resumed by running it again.
+// The progress function, if given, is called after each page of documents.
+func (e *Elastic) RewrapProject(progress func(RewrapProgress)) (*RewrapProgress, error) {
+	vault := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault)
+
+	latest, err := vault.LatestKeyVersion(e.Project)
+	if err != nil {
+		e.Logger.Error("Failed to get the latest key version", zap.String("project", e.Project), zap.Error(err))
+		return nil, err
+	}
+
+	result := &RewrapProgress{KeyVersion: latest}
+	for _, index := range []string{e.StateIndex, e.ResourceIndex} {
+		result.Index = index
+		if err := e.rewrapIndex(vault, index, result, progress); err != nil {
+			return result, err
+		}
+	}
+
+	e.Logger.Info("Project rewrapped", zap.String("project", e.Project), zap.Int("key_version", latest),
+		zap.Int("documents", result.Documents), zap.Int("updated", result.Updated), zap.Int("values", result.Values),
+		zap.Int("conflicts", result.Conflicts), zap.Int("failed", result.Failed))
+	return result, nil
+}
+
+// rewrapIndex rewraps the documents of the project in the index, page by page.
+func (e *Elastic) rewrapIndex(vault *vaultop.Vault, index string, result *RewrapProgress, progress func(RewrapProgress)) error {
+	return e.updateDocumentPages(index, func(documents []*rewrapDocument) (int, error) {
+		written, err := e.rewrapDocuments(vault, index, documents, result)
+		if err != nil {
+			return 0, err
+		}
+		if progress != nil {
+			progress(*result)
+		}
+		return written, nil
+	})
+}
+
+// updateDocumentPages reads the documents of the project in the index page by page, and passes each page to
+// the update function, which returns the number of documents it wrote back. The index is refreshed at the end
+// if any document was written.
+func (e *Elastic) updateDocumentPages(index string, update func([]*rewrapDocument) (int, error)) error {
+	// Open a point in time, so the pages are consistent with each other.
+	pitID, err := e.openPointInTime(index)
+	if err != nil {
+		return err
+	}
+	if pitID == "" {
+		// The index doesn't exist yet.
+		return nil
+	}
+	defer func() { e.closePointInTime(pitID) }()
+
+	var searchAfter []interface{}
+	updated := false
+	for {
+		documents, nextPitID, next, err := e.rewrapPage(index, pitID, searchAfter)
+		if err != nil {
+			return err
+		}
+		pitID = nextPitID
+		searchAfter = next
+
+		written, err := update(documents)
+		if err != nil {
+			return err
+		}
+		updated = updated || written > 0
+
+		// The last page is shorter than the page size.
+		if len(documents) < rewrapPageSize {
+			break
+		}
+	}
+
+	if updated {
+		return e.refreshIndex(index)
+	}
+	return nil
+}
+
+// rewrapPage fetches the next page of documents of the project in the index, with their sequence numbers.
+// It returns the point in time ID and the sort values to fetch the following page.
+func (e *Elastic) rewrapPage(index, pitID string, searchAfter []interface{}) ([]*rewrapDocument, string, []interface{}, error) {
+	var buf bytes.Buffer
+
+	// Define Elasticsearch query to fetch the next page of documents of the project, in all workspaces.
+	query := map[string]interface{}{
+		"query": map[string]interface{}{
+			"term": map[string]interface{}{"project": e.Project},
+		},
+		"size":                rewrapPageSize,
+		"seq_no_primary_term": true,
+		"pit": map[string]interface{}{
+			"id":         pitID,
+			"keep_alive": pointInTimeKeepAlive,
+		},
+		"sort": []map[string]interface{}{
+			{"_shard_doc": map[string]interface{}{"order": "asc"}},
+		},
+	}
+	if searchAfter != nil {
+		query["search_after"] = searchAfter
+	}
+
+	// Encode the Elasticsearch query
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+		return nil, "", nil, err
+	}
+
+	// Search for the documents in Elasticsearch
+	res, err := e.Client.Search(
+		e.Client.Search.WithContext(e.Ctx),
+		e.Client.Search.WithBody(&buf),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+		return nil, "", nil, err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		e.Logger.Error("Error searching the documents", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+		return nil, "", nil, fmt.Errorf("error searching documents in %s: %s", index, res.Status())
+	}
+
+	// Parse response from Elasticsearch, keeping numbers as they were stored
+	var r struct {
+		PitID string `json:"pit_id"`
+		Hits  struct {
+			Hits []struct {
+				ID          string                 `json:"_id"`
+				SeqNo       int64                  `json:"_seq_no"`
+				PrimaryTerm int64                  `json:"_primary_term"`
+				Source      map[string]interface{} `json:"_source"`
+				Sort        []interface{}          `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+		return nil, "", nil, err
+	}
+
+	// The point in time ID may change between pages.
+	if r.PitID != "" {
+		pitID = r.PitID
+	}
+
+	documents := make([]*rewrapDocument, 0, len(r.Hits.Hits))
+	for _, hit := range r.Hits.Hits {
+		documents = append(documents, &rewrapDocument{
+			ID:          hit.ID,
+			SeqNo:       hit.SeqNo,
+			PrimaryTerm: hit.PrimaryTerm,
+			Source:      hit.Source,
+		})
+		searchAfter = hit.Sort
+	}
+	return documents, pitID, searchAfter, nil
+}
+
+// rewrapDocuments rewraps the outdated values of the documents with Vault in a batch, and writes the changed
+// documents back, provided they weren't changed since they were read. It returns the number of documents written.
+func (e *Elastic) rewrapDocuments(vault *vaultop.Vault, index string, documents []*rewrapDocument, result *RewrapProgress) (int, error) {
+	result.Documents += len(documents)
+
+	// Collect the values encrypted with an older key version.
+	var jobs []rewrapJob
+	for i, document := range documents {
+		collectRewrapJobs(document.Source, i, result.KeyVersion, &jobs)
+	}
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	ciphertexts := make([]string, len(jobs))
+	for i, job := range jobs {
+		ciphertexts[i] = job.ciphertext
+	}
+	results, err := vault.RewrapBatchWithVault(ciphertexts, e.Project)
+	if err != nil {
+		return 0, err
+	}
+
+	// Store the rewrapped values. Documents with a value which couldn't be rewrapped are left as they were.
+	changed := map[int]int{}
+	for i, job := range jobs {
+		if results[i].Err != nil {
+			e.Logger.Error("Failed to rewrap value", zap.String("index", index), zap.String("id", documents[job.document].ID), zap.Error(results[i].Err))
+			documents[job.document].Failed = true
+			continue
+		}
+		job.set(job.prefix + results[i].Value)
+		changed[job.document]++
+	}
+
+	written, err := e.writeDocuments(index, documents, changed)
+	if err != nil {
+		return 0, err
+	}
+	result.Updated += written.updated
+	result.Values += written.values
+	result.Conflicts += written.conflicts
+	result.Failed += written.failed
+	return written.updated, nil
+}
+
+// documentWrites counts the outcome of writing back changed documents.
+type documentWrites struct {
+	updated, values, conflicts, failed int
+}
+
+// writeDocuments writes back the documents with changed values, provided they weren't changed since they
+// were read. Documents marked as failed are counted as failures and left as they were, including those
+// none of whose values could be changed.
+func (e *Elastic) writeDocuments(index string, documents []*rewrapDocument, changed map[int]int) (documentWrites, error) {
+	var result documentWrites
+
+	var buf bytes.Buffer
+	var written []int
+	for position, document := range documents {
+		if document.Failed {
+			result.failed++
+			continue
+		}
+		if changed[position] == 0 {
+			continue
+		}
+
+		// Encode the action and the document, which is only replaced if it is unchanged.
+		action := map[string]interface{}{"index": map[string]interface{}{
+			"_index":          index,
+			"_id":             document.ID,
+			"if_seq_no":       document.SeqNo,
+			"if_primary_term": document.PrimaryTerm,
+		}}
+		if err := json.NewEncoder(&buf).Encode(action); err != nil {
+			e.Logger.Error("Error encoding bulk action", zap.Error(err))
+			return result, err
+		}
+		if err := json.NewEncoder(&buf).Encode(document.Source); err != nil {
+			e.Logger.Error("Error encoding document", zap.Error(err))
+			return result, err
+		}
+		written = append(written, position)
+	}
+	if len(written) == 0 {
+		return result, nil
+	}
+
+	itemErrors, err := e.sendBulk(&buf, 0)
+	if err != nil {
+		return result, err
+	}
+	failed := map[int]bool{}
+	for _, item := range itemErrors {
+		document := written[item.Position]
+		failed[document] = true
+		if item.Type == "version_conflict_engine_exception" {
+			e.Logger.Warn("Document changed concurrently, skipping it", zap.String("index", index), zap.String("id", documents[document].ID))
+			result.conflicts++
+		} else {
+			e.Logger.Error("Failed to write document", zap.String("index", index), zap.String("id", documents[document].ID),
+				zap.Int("status_code", item.Status), zap.String("type", item.Type), zap.String("reason", item.Reason))
+			result.failed++
+		}
+	}
+	for _, document := range written {
+		if !failed[document] {
+			result.updated++
+			result.values += changed[document]
+		}
+	}
+
+	return result, nil
+}
+
+// collectRewrapJobs adds the values in the node which are encrypted with a key version older than the latest one.
+// This covers the encrypted fields in both envelopes and the encrypted raw state.
+func collectRewrapJobs(node interface{}, document, latest int, jobs *[]rewrapJob) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if job, ok := newRewrapJob(val, document, latest); ok {
+				job.set = func(value interface{}) { v[k] = value }
+				*jobs = append(*jobs, job)
+				continue
+			}
+			collectRewrapJobs(val, document, latest, jobs)
+		}
+	case []interface{}:
+		for i, val := range v {
+			if job, ok := newRewrapJob(val, document, latest); ok {
+				job.set = func(value interface{}) { v[i] = value }
+				*jobs = append(*jobs, job)
+				continue
+			}
+			collectRewrapJobs(val, document, latest, jobs)
+		}
+	}
+}
+
+// newRewrapJob returns the job rewrapping the value if it is encrypted with a key version older than the latest one.
+func newRewrapJob(val interface{}, document, latest int) (rewrapJob, bool) {
+	s, ok := val.(string)
+	if !ok || !isEncrypted(s) {
+		return rewrapJob{}, false
+	}
+
+	// Split the envelope from the ciphertext, which starts with vault:.
+	start := strings.Index(s, "vault:")
+	prefix, ciphertext := s[:start], s[start:]
+
+	match := ciphertextVersion.FindStringSubmatch(ciphertext)
+	if match == nil {
+		return rewrapJob{}, false
+	}
+	version, err := strconv.Atoi(match[1])
+	if err != nil || version >= latest {
+		return rewrapJob{}, false
+	}
+	return rewrapJob{document: document, prefix: prefix, ciphertext: ciphertext}, true
+}
@@ -0,0 +1,124 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RollbackState makes the committed version with the given ID the current state again. The version is
+// copied as a new version with the lineage of the version and a serial greater than both the serial of
+// the version and of the current state, so Terraform accepts it as the latest state.
+// The documents are copied as they are stored, without decrypting them, except the raw state,
+// which is stored again with the new serial.
+// It returns the new version.
+func (e *Elastic) RollbackState(id string) (*StateVersion, int, error) {
+	// Get the current timestamp in UTC format.
+	currentTime := time.Now().UTC().Format(time.RFC3339)
+
+	// Read the version to roll back to.
+	source, httpStatus, err := e.getVersionDocument(id)
+	if err != nil {
+		return nil, httpStatus, err
+	}
+
+	// Read the resources of the version.
+	timestamp, _ := source["timestamp"].(string)
+	generation, _ := source["generation"].(string)
+	resources, err := e.GetResources(generation, timestamp)
+	if err != nil {
+		e.Logger.Error("Error fetching the resources from Elasticsearch", zap.Error(err))
+		return nil, http.StatusInternalServerError, fmt.Errorf("error fetching resources: %s", err)
+	}
+
+	// Read the current version, which the copy replaces.
+	current, pointer, err := e.currentState()
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Bump the serial above both the version and the current state.
+	serial, _ := source["serial"].(float64)
+	if current != nil {
+		if currentSerial, ok := current["serial"].(float64); ok && currentSerial > serial {
+			serial = currentSerial
+		}
+	}
+	serial++
+
+	// Generate the ID of the new version.
+	newGeneration, err := newGenerationID()
+	if err != nil {
+		e.Logger.Error("Failed to generate generation ID", zap.Error(err))
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// Copy the state document with the new serial, dropping the fields of the original version.
+	stateMap := map[string]interface{}{}
+	for key, value := range source {
+		stateMap[key] = value
+	}
+	stripInternalFields(stateMap)
+	stateMap["serial"] = serial
+	stateMap["timestamp"] = currentTime
+	stateMap["author"] = e.Author
+	stateMap["resource_count"] = len(resources)
+	if size, ok := source["size"]; ok {
+		stateMap["size"] = size
+	}
+
+	// Store the raw state of the version with the new serial, if it was stored.
+	raw, err := e.decodeRawState(source)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("error reading raw state: %s", err)
+	}
+	if raw != nil {
+		var rawMap map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&rawMap); err != nil {
+			e.Logger.Error("Failed to unmarshal the raw state", zap.Error(err))
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to unmarshal raw state: %s", err)
+		}
+		rawMap["serial"] = int64(serial)
+
+		updated, err := json.Marshal(rawMap)
+		if err != nil {
+			e.Logger.Error("Failed to marshal the raw state", zap.Error(err))
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to marshal raw state: %s", err)
+		}
+		if stateMap[rawStateField], err = e.encodeRawState(updated); err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("error encoding raw state: %s", err)
+		}
+		stateMap["size"] = len(updated)
+	}
+
+	// Copy the resources, which keep their stored order.
+	copies := make([]interface{}, 0, len(resources))
+	for _, resource := range resources {
+		stripInternalFields(resource)
+		copies = append(copies, resource)
+	}
+
+	// Save the copy and commit it.
+	if httpStatus, err := e.writeVersion(newGeneration, pointer, stateMap, copies); err != nil {
+		return nil, httpStatus, err
+	}
+
+	e.Logger.Info("Successfully rolled back state", zap.String("project", e.Project), zap.String("version", id), zap.String("generation", newGeneration), zap.Float64("serial", serial))
+
+	lineage, _ := stateMap["lineage"].(string)
+	resourceCount := int64(len(resources))
+	return &StateVersion{
+		ID:            newGeneration,
+		Serial:        int64(serial),
+		Lineage:       lineage,
+		Timestamp:     currentTime,
+		Author:        e.Author,
+		ResourceCount: &resourceCount,
+	}, http.StatusOK, nil
+}
@@ -0,0 +1,126 @@
+package elasticop
+
+import (
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// encryptSensitive encrypts the values Terraform flags as sensitive in the state: the attributes listed in
+// the sensitive_attributes of each resource instance, and the values of outputs marked as sensitive.
+// Values which are already encrypted are left as they are. The values are encrypted with Vault in batches.
+func (e *Elastic) encryptSensitive(stateMap map[string]interface{}) error {
+	batch := &cryptBatch{encrypt: true}
+
+	// Encrypt the values of sensitive outputs.
+	outputs, _ := stateMap["outputs"].(map[string]interface{})
+	for name, item := range outputs {
+		output, ok := item.(map[string]interface{})
+		if !ok || output["sensitive"] != true {
+			continue
+		}
+		if err := encryptInPlace(batch, output, "value"); err != nil {
+			e.Logger.Error("Failed to encrypt sensitive output", zap.String("output", name), zap.Error(err))
+			return err
+		}
+	}
+
+	// Encrypt the sensitive attributes of each resource instance.
+	resources, _ := stateMap["resources"].([]interface{})
+	for _, resourceItem := range resources {
+		resource, ok := resourceItem.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		instances, _ := resource["instances"].([]interface{})
+		for _, instanceItem := range instances {
+			instance, ok := instanceItem.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			paths, _ := instance["sensitive_attributes"].([]interface{})
+			for _, path := range paths {
+				steps, _ := path.([]interface{})
+				if err := encryptAttributePath(batch, instance["attributes"], steps); err != nil {
+					e.Logger.Error("Failed to encrypt sensitive attribute", zap.Any("type", resource["type"]), zap.Any("name", resource["name"]), zap.Error(err))
+					return err
+				}
+			}
+		}
+	}
+
+	return e.runCryptBatch(batch)
+}
+
+// encryptAttributePath adds the attribute at the path to the batch. The path is given as the steps Terraform records in
+// sensitive_attributes, like [{"type": "get_attr", "value": "password"}]. Paths which don't exist
+// in the attributes are ignored.
+func encryptAttributePath(batch *cryptBatch, attributes interface{}, steps []interface{}) error {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	node := attributes
+	for i, stepItem := range steps {
+		step, ok := stepItem.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		last := i == len(steps)-1
+
+		// Find the key of the step within the current node.
+		var key interface{}
+		switch step["type"] {
+		case "get_attr":
+			key = step["value"]
+		case "index":
+			index, _ := step["value"].(map[string]interface{})
+			key = index["value"]
+		default:
+			return nil
+		}
+
+		switch v := node.(type) {
+		case map[string]interface{}:
+			name, ok := key.(string)
+			if !ok {
+				return nil
+			}
+			if _, exists := v[name]; !exists {
+				return nil
+			}
+			if last {
+				return encryptInPlace(batch, v, name)
+			}
+			node = v[name]
+		case []interface{}:
+			position, ok := key.(float64)
+			if !ok || position < 0 || int(position) >= len(v) {
+				return nil
+			}
+			if last {
+				return encryptElementInPlace(batch, v, int(position))
+			}
+			node = v[int(position)]
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// encryptInPlace adds the value of the key in the map to the batch, unless it is already encrypted.
+func encryptInPlace(batch *cryptBatch, m map[string]interface{}, key string) error {
+	if str, ok := m[key].(string); ok && isEncrypted(str) {
+		return nil
+	}
+	return batch.addEncrypt("."+key, m[key], func(value interface{}) { m[key] = value })
+}
+
+// encryptElementInPlace adds the element of the slice to the batch, unless it is already encrypted.
+func encryptElementInPlace(batch *cryptBatch, s []interface{}, index int) error {
+	if str, ok := s[index].(string); ok && isEncrypted(str) {
+		return nil
+	}
+	return batch.addEncrypt("["+strconv.Itoa(index)+"]", s[index], func(value interface{}) { s[index] = value })
+}
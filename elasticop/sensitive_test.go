@@ -0,0 +1,79 @@
+package elasticop
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEncryptSensitivePaths(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	withFakeTransit(t, e)
+
+	encrypted := "tfb_string:" + fakeCiphertext(`"encrypted"`)
+	var stateMap map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"outputs": {
+			"password": {"value": "secret", "type": "string", "sensitive": true},
+			"address": {"value": "10.0.0.1", "type": "string"}
+		},
+		"resources": [{"mode": "managed", "type": "db", "name": "main", "instances": [{
+			"attributes": {
+				"password": "secret",
+				"port": 5432,
+				"tags": {"owner": "team", "token": "secret"},
+				"users": ["admin", "secret"],
+				"nested": [{"key": "secret", "name": "nested"}],
+				"encrypted": "`+encrypted+`",
+				"plain": "plain"
+			},
+			"sensitive_attributes": [
+				[{"type": "get_attr", "value": "password"}],
+				[{"type": "get_attr", "value": "port"}],
+				[{"type": "get_attr", "value": "tags"}, {"type": "index", "value": {"value": "token", "type": "string"}}],
+				[{"type": "get_attr", "value": "users"}, {"type": "index", "value": {"value": 1, "type": "number"}}],
+				[{"type": "get_attr", "value": "nested"}, {"type": "index", "value": {"value": 0, "type": "number"}}, {"type": "get_attr", "value": "key"}],
+				[{"type": "get_attr", "value": "encrypted"}],
+				[{"type": "get_attr", "value": "missing"}],
+				[{"type": "get_attr", "value": "users"}, {"type": "index", "value": {"value": 5, "type": "number"}}],
+				[{"type": "get_attr", "value": "tags"}, {"type": "index", "value": {"value": 0, "type": "number"}}],
+				[{"type": "unknown", "value": "plain"}],
+				[]
+			]
+		}]}]
+	}`), &stateMap)
+	if err != nil {
+		t.Fatalf("failed to parse the state: %s", err)
+	}
+
+	if err := e.encryptSensitive(stateMap); err != nil {
+		t.Fatalf("encryptSensitive failed: %s", err)
+	}
+
+	// Sensitive outputs are encrypted, other outputs are left as they are.
+	outputs := stateMap["outputs"].(map[string]interface{})
+	if value := outputs["password"].(map[string]interface{})["value"]; value != "tfb_string:"+fakeCiphertext(`"secret"`) {
+		t.Errorf("expected the sensitive output to be encrypted, got %v", value)
+	}
+	if value := outputs["address"].(map[string]interface{})["value"]; value != "10.0.0.1" {
+		t.Errorf("expected the output to be left as it is, got %v", value)
+	}
+
+	// The values at the sensitive paths are encrypted with their type, whatever the nesting, while paths which
+	// don't resolve to a value and values already encrypted are left alone.
+	resource := stateMap["resources"].([]interface{})[0].(map[string]interface{})
+	attributes := resource["instances"].([]interface{})[0].(map[string]interface{})["attributes"].(map[string]interface{})
+	expected := map[string]interface{}{
+		"password":  "tfb_string:" + fakeCiphertext(`"secret"`),
+		"port":      "tfb_number:" + fakeCiphertext("5432"),
+		"tags":      map[string]interface{}{"owner": "team", "token": "tfb_string:" + fakeCiphertext(`"secret"`)},
+		"users":     []interface{}{"admin", "tfb_string:" + fakeCiphertext(`"secret"`)},
+		"nested":    []interface{}{map[string]interface{}{"key": "tfb_string:" + fakeCiphertext(`"secret"`), "name": "nested"}},
+		"encrypted": encrypted,
+		"plain":     "plain",
+	}
+	if !reflect.DeepEqual(attributes, expected) {
+		t.Errorf("unexpected attributes\n got: %v\nwant: %v", attributes, expected)
+	}
+}
@@ -1,8 +1,10 @@
 package elasticop
 
 import (
-	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
@@ -10,27 +12,60 @@ import (
 	"go.uber.org/zap"
 )
 
-// StoreState saves the provided state to Elasticsearch. It first stores individual resources
-// and then the entire state minus the resources.
-func (e *Elastic) StoreState(updatedState []byte) (int, error) {
-	var buf bytes.Buffer
-
+// StoreState saves the provided state to Elasticsearch as a new version. It first stores the entire state
+// minus the resources, then the individual resources, all linked by a generation ID unique to each call.
+// Finally, the new version is committed by pointing the state pointer of the project to it, so a write
+// failing midway never becomes visible.
+// Unless force is set, the state must have the lineage of the current state and a greater serial.
+func (e *Elastic) StoreState(updatedState []byte, force bool) (int, error) {
 	// Get the current timestamp in UTC format.
 	currentTime := time.Now().UTC().Format(time.RFC3339)
 
+	// Generate the ID linking the state to its resources.
+	generation, err := newGenerationID()
+	if err != nil {
+		e.Logger.Error("Failed to generate generation ID", zap.Error(err))
+		return http.StatusInternalServerError, err
+	}
+
 	// Parse the input state to an interface type.
 	var stateData interface{}
-	err := json.Unmarshal([]byte(updatedState), &stateData)
+	err = json.Unmarshal([]byte(updatedState), &stateData)
 	if err != nil {
 		e.Logger.Error("Failed to unmarshal updatedState", zap.Error(err))
 		return http.StatusInternalServerError, fmt.Errorf("failed to unmarshal updatedState: %s", err)
 	}
 
-	// Modify data if encryption is required.
-	e.TraverseAndModify(stateData, e.Encrypt, true)
-
 	// Assert the state data to a map.
-	var stateMap map[string]interface{} = stateData.(map[string]interface{})
+	stateMap, ok := stateData.(map[string]interface{})
+	if !ok {
+		return http.StatusBadRequest, fmt.Errorf("malformed state: not a JSON object")
+	}
+
+	// Read the current version, which the new version replaces.
+	current, pointer, err := e.currentState()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Reject states which don't continue the current state, unless the write is forced.
+	if !force {
+		if httpStatus, err := e.checkStateConflict(stateMap, current); err != nil {
+			return httpStatus, err
+		}
+	}
+
+	// Encrypt the values Terraform flags as sensitive, if enabled.
+	if e.EncryptSensitive {
+		if err := e.encryptSensitive(stateMap); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("error encrypting sensitive values: %s", err)
+		}
+	}
+
+	// Modify data if encryption is required. Nothing is stored if a value can't be encrypted.
+	if err := e.TraverseAndModify(stateData, e.Encrypt, true); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error encrypting values: %s", err)
+	}
 
 	// Extract the resources section from the state data.
 	resources, ok := stateMap["resources"].([]interface{})
@@ -38,66 +73,121 @@ func (e *Elastic) StoreState(updatedState []byte) (int, error) {
 		return http.StatusInternalServerError, fmt.Errorf("malformed state: missing resources")
 	}
 
-	// Process and store each resource in Elasticsearch.
-	for _, resource := range resources {
-		var resourceMap map[string]interface{}
-		if resourceMap, ok = resource.(map[string]interface{}); ok {
-			resourceMap["timestamp"] = currentTime
-		} else {
-			return http.StatusInternalServerError, fmt.Errorf("failed to type assert resource to map[string]interface{}")
-		}
+	// Remove the resources key from the state map since they are stored separately.
+	delete(stateMap, "resources")
+
+	// Store the state as it was posted, so it is returned unchanged.
+	rawState, err := e.encodeRawState(updatedState)
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("error encoding raw state: %s", err)
+	}
+	stateMap[rawStateField] = rawState
+
+	// Add a timestamp and the details listed in the version history to the state data.
+	stateMap["timestamp"] = currentTime
+	stateMap["author"] = e.Author
+	stateMap["resource_count"] = len(resources)
+	stateMap["size"] = len(updatedState)
+
+	// Save the new version and commit it.
+	if httpStatus, err := e.writeVersion(generation, pointer, stateMap, resources); err != nil {
+		return httpStatus, err
+	}
+
+	// Log the successful operation.
+	e.Logger.Info("Successfully stored state to Elasticsearch", zap.String("timestamp", currentTime), zap.String("generation", generation), zap.String("project", e.Project))
+
+	// Remove versions abandoned by failed writes.
+	if err := e.CleanupUncommitted(); err != nil {
+		e.Logger.Warn("Failed to clean up uncommitted states", zap.String("project", e.Project), zap.Error(err))
+	}
 
-		// Reset buffer for new data.
-		buf.Reset()
+	return http.StatusOK, nil
+}
 
-		// Encode the resource data.
-		if err := json.NewEncoder(&buf).Encode(resourceMap); err != nil {
-			e.Logger.Error("Error encoding resource data", zap.Error(err))
+// writeVersion stores the state document and the resources of a new version of the state,
+// and commits it by moving the pointer read together with the current version to it.
+// The state map must not contain the resources, and must already have its timestamp set.
+func (e *Elastic) writeVersion(generation string, pointer *statePointer, stateMap map[string]interface{}, resources []interface{}) (int, error) {
+	// Make sure the backend fields are mapped before the documents are stored.
+	for _, index := range []string{e.StateIndex, e.ResourceIndex} {
+		if err := e.ensureIndex(index, stateDocumentMappings); err != nil {
 			return http.StatusInternalServerError, err
 		}
+	}
 
-		// Save the resource data to Elasticsearch.
-		res, err := e.Client.Index(
-			e.ResourceIndex,
-			&buf,
-			e.Client.Index.WithRefresh("true"),
-		)
-		if err != nil || res.IsError() {
-			e.Logger.Error("Error saving resource to Elasticsearch", zap.Error(err))
-			return http.StatusInternalServerError, fmt.Errorf("error saving resource: %s", err)
-		}
-		defer res.Body.Close()
+	// Save the state data to Elasticsearch, not yet committed.
+	if err := e.writeStateDocument(generation, pointer, stateMap); err != nil {
+		return http.StatusInternalServerError, err
 	}
 
-	// Remove the resources key from the state map since we've already processed them.
-	delete(stateMap, "resources")
+	// Prepare each resource for Elasticsearch, recording its position in the state.
+	resourceDocs := make([]map[string]interface{}, 0, len(resources))
+	for i, resource := range resources {
+		resourceMap, ok := resource.(map[string]interface{})
+		if !ok {
+			return http.StatusInternalServerError, fmt.Errorf("failed to type assert resource to map[string]interface{}")
+		}
+		resourceMap["position"] = i
+		resourceMap["timestamp"] = stateMap["timestamp"]
+		resourceMap["generation"] = generation
+		resourceMap["project"] = e.Project
+		resourceMap["workspace"] = e.Workspace
+		resourceDocs = append(resourceDocs, resourceMap)
+	}
 
-	// Add a timestamp to the state data.
-	stateMap["timestamp"] = currentTime
+	// Save the resources to Elasticsearch in bulk.
+	if err := e.bulkIndex(e.ResourceIndex, resourceDocs); err != nil {
+		e.Logger.Error("Error saving resources to Elasticsearch", zap.String("generation", generation), zap.Error(err))
+		return http.StatusInternalServerError, fmt.Errorf("error saving resources: %s", err)
+	}
 
-	// Reset buffer for new data.
-	buf.Reset()
+	// Make the resources searchable before the new version becomes visible.
+	if err := e.refreshIndex(e.ResourceIndex); err != nil {
+		return http.StatusInternalServerError, err
+	}
 
-	// Encode the state data.
-	if err := json.NewEncoder(&buf).Encode(stateMap); err != nil {
-		e.Logger.Error("Error Error encoding data", zap.Error(err))
+	// Commit the new version.
+	if err := e.commitGeneration(pointer, stateMap); err != nil {
+		if errors.Is(err, ErrStateChanged) {
+			return http.StatusConflict, err
+		}
 		return http.StatusInternalServerError, err
 	}
 
-	// Save the state data to Elasticsearch.
-	res, err := e.Client.Index(
-		e.StateIndex,
-		&buf,
-		e.Client.Index.WithRefresh("true"),
-	)
-	if err != nil || res.IsError() {
-		e.Logger.Error("Error saving state to Elasticsearch", zap.Error(err))
-		return http.StatusInternalServerError, fmt.Errorf("error saving state: %s", err)
+	return http.StatusOK, nil
+}
+
+// newGenerationID returns a random ID identifying a stored version of the state.
+func newGenerationID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// checkStateConflict verifies that the new state continues the current state,
+// meaning that it has the same lineage and a greater serial.
+// It returns http.StatusConflict with a descriptive error otherwise.
+func (e *Elastic) checkStateConflict(stateMap, current map[string]interface{}) (int, error) {
+	// Any state can be stored if there is no state yet, or it was deleted.
+	if current == nil || current["deleted"] == true {
+		return http.StatusOK, nil
 	}
-	defer res.Body.Close()
 
-	// Log the successful operation.
-	e.Logger.Info("Successfully stored state to Elasticsearch", zap.String("timestamp", currentTime), zap.String("project", e.Project))
+	lineage, _ := stateMap["lineage"].(string)
+	currentLineage, _ := current["lineage"].(string)
+	if currentLineage != "" && lineage != currentLineage {
+		e.Logger.Warn("Rejecting state with different lineage", zap.String("project", e.Project), zap.String("lineage", lineage), zap.String("current_lineage", currentLineage))
+		return http.StatusConflict, fmt.Errorf("state lineage %q doesn't match the current lineage %q", lineage, currentLineage)
+	}
+
+	serial, _ := stateMap["serial"].(float64)
+	if currentSerial, ok := current["serial"].(float64); ok && serial <= currentSerial {
+		e.Logger.Warn("Rejecting state with stale serial", zap.String("project", e.Project), zap.Float64("serial", serial), zap.Float64("current_serial", currentSerial))
+		return http.StatusConflict, fmt.Errorf("state serial %.0f is not greater than the current serial %.0f", serial, currentSerial)
+	}
 
 	return http.StatusOK, nil
 }
@@ -0,0 +1,69 @@
+package elasticop
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// stateJSON returns a state with the given lineage and serial, and a single resource.
+func stateJSON(lineage string, serial int) []byte {
+	return []byte(fmt.Sprintf(`{"version": 4, "lineage": %q, "serial": %d, "outputs": {}, "resources": `+
+		`[{"mode": "managed", "type": "null_resource", "name": "main", "instances": [{"attributes": {"id": "1"}}]}]}`, lineage, serial))
+}
+
+func TestStoreStateRejectsConflicts(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	if httpStatus, err := e.StoreState(stateJSON("lineage", 2), false); err != nil {
+		t.Fatalf("StoreState failed with %d: %s", httpStatus, err)
+	}
+
+	// States which don't continue the current state are rejected, and the current state is kept.
+	for name, state := range map[string][]byte{
+		"stale serial":      stateJSON("lineage", 1),
+		"same serial":       stateJSON("lineage", 2),
+		"different lineage": stateJSON("other", 3),
+	} {
+		if httpStatus, err := e.StoreState(state, false); err == nil || httpStatus != http.StatusConflict {
+			t.Errorf("expected a state with a %s to be rejected with a conflict, got %d (%v)", name, httpStatus, err)
+		}
+	}
+	current, _, err := e.currentState()
+	if err != nil || current["serial"] != float64(2) {
+		t.Fatalf("expected the current state to be kept, got serial %v (%v)", current["serial"], err)
+	}
+
+	// A forced write overrides the checks.
+	if httpStatus, err := e.StoreState(stateJSON("other", 1), true); err != nil {
+		t.Fatalf("expected the forced write to succeed, got %d (%v)", httpStatus, err)
+	}
+	current, _, err = e.currentState()
+	if err != nil || current["lineage"] != "other" || current["serial"] != float64(1) {
+		t.Fatalf("expected the forced state to be current, got %v/%v (%v)", current["lineage"], current["serial"], err)
+	}
+
+	// The next write continues the forced state.
+	if httpStatus, err := e.StoreState(stateJSON("other", 2), false); err != nil {
+		t.Fatalf("expected the write after the forced write to succeed, got %d (%v)", httpStatus, err)
+	}
+}
+
+func TestWriteAudit(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", "staging")
+
+	if err := e.WriteAudit("force-push", "admin", "restore backup", map[string]interface{}{"serial": 7}); err != nil {
+		t.Fatalf("WriteAudit failed: %s", err)
+	}
+	docs := cluster.documents("terraform-audit")
+	if len(docs) != 1 {
+		t.Fatalf("expected a single audit record, got %d", len(docs))
+	}
+	record := docs[0].source
+	if record["action"] != "force-push" || record["user"] != "admin" || record["reason"] != "restore backup" ||
+		record["project"] != "app" || record["workspace"] != "staging" || record["timestamp"] == nil {
+		t.Fatalf("unexpected audit record %v", record)
+	}
+}
@@ -0,0 +1,307 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// templateVersion is the version of the index templates installed by the backend.
+// It must be increased whenever the templates change, so outdated templates are replaced.
+const templateVersion = 4
+
+// templateManager identifies the index templates installed by the backend.
+const templateManager = "terraform-elastic-backend"
+
+// templatePriority is the priority of the index templates, which takes precedence over generic templates.
+const templatePriority = 500
+
+// flattenedDepthLimit is the maximum depth of the attribute blobs indexed as flattened fields.
+const flattenedDepthLimit = 100
+
+// flattenedIgnoreAbove is the length above which the values of flattened fields are kept in the source but
+// not indexed. Longer values, such as certificates or policies, could exceed the 32766 bytes Elasticsearch
+// indexes as a term, which is 8191 characters of up to 4 bytes.
+const flattenedIgnoreAbove = 8191
+
+// verifiedTemplates records the index templates which were verified, keyed by cluster addresses and index name,
+// so the verification is only performed once per process.
+var verifiedTemplates sync.Map
+
+// stateTemplateMappings returns the mappings of the state index. Outputs are indexed as a flattened field,
+// so arbitrary outputs don't add mappings, and the remaining fields of the state are not indexed.
+func stateTemplateMappings() map[string]interface{} {
+	return withProperties(stateDocumentMappings, "false", map[string]interface{}{
+		"version":           map[string]interface{}{"type": "long"},
+		"terraform_version": map[string]interface{}{"type": "keyword"},
+		"outputs":           map[string]interface{}{"type": "flattened", "depth_limit": flattenedDepthLimit, "ignore_above": flattenedIgnoreAbove},
+		"check_results":     map[string]interface{}{"type": "object", "enabled": false},
+	})
+}
+
+// resourceTemplateMappings returns the mappings of the resource index. The instances, which hold the
+// attributes of the resources, are indexed as a flattened field, so arbitrary attributes don't add mappings.
+func resourceTemplateMappings() map[string]interface{} {
+	return withProperties(stateDocumentMappings, "false", map[string]interface{}{
+		"mode":      map[string]interface{}{"type": "keyword"},
+		"type":      map[string]interface{}{"type": "keyword"},
+		"name":      map[string]interface{}{"type": "keyword"},
+		"module":    map[string]interface{}{"type": "keyword"},
+		"provider":  map[string]interface{}{"type": "keyword"},
+		"each":      map[string]interface{}{"type": "keyword"},
+		"instances": map[string]interface{}{"type": "flattened", "depth_limit": flattenedDepthLimit, "ignore_above": flattenedIgnoreAbove},
+	})
+}
+
+// withProperties returns a copy of the mappings extended with the properties and the dynamic setting.
+func withProperties(mappings map[string]interface{}, dynamic string, properties map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	if base, ok := mappings["properties"].(map[string]interface{}); ok {
+		for name, field := range base {
+			merged[name] = field
+		}
+	}
+	for name, field := range properties {
+		merged[name] = field
+	}
+	return map[string]interface{}{
+		"dynamic":    dynamic,
+		"properties": merged,
+	}
+}
+
+// indexTemplates returns the mappings of each index used by the backend, keyed by the index name.
+func (e *Elastic) indexTemplates() map[string]map[string]interface{} {
+	return map[string]map[string]interface{}{
+		e.StateIndex:       stateTemplateMappings(),
+		e.ResourceIndex:    resourceTemplateMappings(),
+		e.PointerIndex:     pointerMappings,
+		e.LockIndex:        lockMappings,
+		e.LockHistoryIndex: lockHistoryMappings,
+		e.AuditIndex:       auditMappings,
+	}
+}
+
+// templateName returns the name of the index template of the index.
+func templateName(index string) string {
+	return templateManager + "-" + index
+}
+
+// InstallTemplates installs or replaces the composable index templates of all indices used by the project.
+// The templates only apply to indices created afterwards.
+func (e *Elastic) InstallTemplates() error {
+	for index, mappings := range e.indexTemplates() {
+		if err := e.putTemplate(index, mappings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Bootstrap installs the index templates and creates the indices used by the project which don't exist yet.
+func (e *Elastic) Bootstrap() error {
+	if err := e.InstallTemplates(); err != nil {
+		return err
+	}
+
+	indices := map[string]map[string]interface{}{
+		e.StateIndex:       stateDocumentMappings,
+		e.ResourceIndex:    stateDocumentMappings,
+		e.PointerIndex:     pointerMappings,
+		e.LockIndex:        lockMappings,
+		e.LockHistoryIndex: lockHistoryMappings,
+		e.AuditIndex:       auditMappings,
+	}
+	for index, mappings := range indices {
+		if err := e.ensureIndex(index, mappings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putTemplate installs the index template of a single index.
+func (e *Elastic) putTemplate(index string, mappings map[string]interface{}) error {
+	var buf bytes.Buffer
+
+	template := map[string]interface{}{
+		"index_patterns": []string{index},
+		"priority":       templatePriority,
+		"version":        templateVersion,
+		"template": map[string]interface{}{
+			"mappings": mappings,
+		},
+		"_meta": map[string]interface{}{
+			"managed_by": templateManager,
+		},
+	}
+
+	// Encode the index template.
+	if err := json.NewEncoder(&buf).Encode(template); err != nil {
+		e.Logger.Error("Error encoding index template", zap.Error(err))
+		return err
+	}
+
+	// Save the index template to Elasticsearch.
+	res, err := e.Client.Indices.PutIndexTemplate(
+		templateName(index),
+		&buf,
+		e.Client.Indices.PutIndexTemplate.WithContext(e.Ctx),
+	)
+	if err != nil {
+		e.Logger.Error("Error installing the index template", zap.String("index", index), zap.Error(err))
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		e.Logger.Error("Failed to install the index template", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+		return fmt.Errorf("failed to install index template for %s: %s", index, res.String())
+	}
+
+	e.Logger.Info("Index template installed", zap.String("index", index), zap.String("template", templateName(index)))
+	return nil
+}
+
+// VerifyTemplates checks that the index templates of all indices used by the project are installed and
+// up to date, and that the existing state and resource indices map the timestamp as a date.
+// It returns the problems found.
+func (e *Elastic) VerifyTemplates() ([]string, error) {
+	var problems []string
+
+	for index := range e.indexTemplates() {
+		version, err := e.installedTemplateVersion(index)
+		if err != nil {
+			return nil, err
+		}
+		if version == 0 {
+			problems = append(problems, fmt.Sprintf("index template %s is missing", templateName(index)))
+		} else if version < templateVersion {
+			problems = append(problems, fmt.Sprintf("index template %s is outdated (version %d, expected %d)", templateName(index), version, templateVersion))
+		}
+	}
+
+	for _, index := range []string{e.StateIndex, e.ResourceIndex} {
+		fieldType, err := e.fieldType(index, "timestamp")
+		if err != nil {
+			return nil, err
+		}
+		if fieldType != "" && fieldType != "date" {
+			problems = append(problems, fmt.Sprintf("index %s maps timestamp as %s instead of date, it must be reindexed", index, fieldType))
+		}
+	}
+
+	return problems, nil
+}
+
+// installedTemplateVersion returns the version of the installed index template of the index, or 0 if it is missing.
+func (e *Elastic) installedTemplateVersion(index string) (int, error) {
+	res, err := e.Client.Indices.GetIndexTemplate(
+		e.Client.Indices.GetIndexTemplate.WithContext(e.Ctx),
+		e.Client.Indices.GetIndexTemplate.WithName(templateName(index)),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting the index template", zap.String("index", index), zap.Error(err))
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return 0, nil
+	}
+	if res.IsError() {
+		e.Logger.Error("Failed to get the index template", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+		return 0, fmt.Errorf("failed to get index template for %s: %s", index, res.String())
+	}
+
+	var r struct {
+		IndexTemplates []struct {
+			IndexTemplate struct {
+				Version int `json:"version"`
+			} `json:"index_template"`
+		} `json:"index_templates"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+		return 0, err
+	}
+	if len(r.IndexTemplates) == 0 {
+		return 0, nil
+	}
+	return r.IndexTemplates[0].IndexTemplate.Version, nil
+}
+
+// fieldType returns the mapped type of the field in the index, or an empty string if the index
+// or the field doesn't exist.
+func (e *Elastic) fieldType(index, field string) (string, error) {
+	res, err := e.Client.Indices.GetFieldMapping(
+		[]string{field},
+		e.Client.Indices.GetFieldMapping.WithContext(e.Ctx),
+		e.Client.Indices.GetFieldMapping.WithIndex(index),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting the field mapping", zap.String("index", index), zap.Error(err))
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if res.IsError() {
+		e.Logger.Error("Failed to get the field mapping", zap.String("index", index), zap.Int("status_code", res.StatusCode))
+		return "", fmt.Errorf("failed to get field mapping of %s: %s", index, res.String())
+	}
+
+	// The response is keyed by the concrete index name, which differs from the index for aliases.
+	var r map[string]struct {
+		Mappings map[string]struct {
+			Mapping map[string]struct {
+				Type string `json:"type"`
+			} `json:"mapping"`
+		} `json:"mappings"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+		return "", err
+	}
+	for _, indexMapping := range r {
+		if fieldMapping, ok := indexMapping.Mappings[field]; ok {
+			return fieldMapping.Mapping[field].Type, nil
+		}
+	}
+	return "", nil
+}
+
+// ensureTemplates verifies the index templates once per process and cluster. Missing or outdated templates
+// are installed if the backend manages them, and reported otherwise. Failures are logged, but don't prevent
+// the backend from working, as the indices are also created with explicit mappings.
+func (e *Elastic) ensureTemplates() {
+	key := strings.Join(e.Addresses, ",") + "|" + e.CloudID + "|" + e.StateIndex + "|" + e.ResourceIndex
+	if _, ok := verifiedTemplates.Load(key); ok {
+		return
+	}
+
+	problems, err := e.VerifyTemplates()
+	if err != nil {
+		e.Logger.Warn("Failed to verify the index templates", zap.String("project", e.Project), zap.Error(err))
+		return
+	}
+
+	for _, problem := range problems {
+		e.Logger.Warn("Index template verification failed", zap.String("project", e.Project), zap.String("problem", problem))
+	}
+	if len(problems) > 0 && e.ManageTemplates {
+		if err := e.InstallTemplates(); err != nil {
+			e.Logger.Warn("Failed to install the index templates", zap.String("project", e.Project), zap.Error(err))
+			return
+		}
+	}
+
+	verifiedTemplates.Store(key, true)
+}
@@ -0,0 +1,60 @@
+package elasticop
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestStoreStateWithLongValues(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	if err := e.InstallTemplates(); err != nil {
+		t.Fatalf("InstallTemplates failed: %s", err)
+	}
+
+	// Attributes and outputs such as certificates can exceed the size Elasticsearch indexes as a term.
+	certificate := strings.Repeat("A", 40*1024)
+	state := []byte(fmt.Sprintf(`{"version": 4, "lineage": "lineage", "serial": 1, `+
+		`"outputs": {"certificate": {"value": %q, "type": "string"}}, "resources": [{"mode": "managed", `+
+		`"type": "tls_certificate", "name": "main", "instances": [{"attributes": {"pem": %q}}]}]}`, certificate, certificate))
+	if httpStatus, err := e.StoreState(state, false); err != nil {
+		t.Fatalf("StoreState failed with %d: %s", httpStatus, err)
+	}
+
+	// The values are stored, though not indexed.
+	body, httpStatus, err := e.GetState()
+	if err != nil {
+		t.Fatalf("GetState failed with %d: %s", httpStatus, err)
+	}
+	var stored struct {
+		Outputs map[string]struct {
+			Value string `json:"value"`
+		} `json:"outputs"`
+		Resources []struct {
+			Instances []struct {
+				Attributes map[string]interface{} `json:"attributes"`
+			} `json:"instances"`
+		} `json:"resources"`
+	}
+	if err := json.Unmarshal(body, &stored); err != nil {
+		t.Fatalf("failed to parse the state: %s", err)
+	}
+	if stored.Outputs["certificate"].Value != certificate {
+		t.Error("expected the long output to be stored")
+	}
+	if len(stored.Resources) != 1 || stored.Resources[0].Instances[0].Attributes["pem"] != certificate {
+		t.Error("expected the long attribute to be stored")
+	}
+
+	// Without ignoring the long values, the cluster fails to index them.
+	for _, mappings := range cluster.templates {
+		for _, property := range mappings["properties"].(map[string]interface{}) {
+			delete(property.(map[string]interface{}), "ignore_above")
+		}
+	}
+	if _, err := e.StoreState([]byte(strings.Replace(string(state), `"serial": 1`, `"serial": 2`, 1)), false); err == nil {
+		t.Fatal("expected long values of flattened fields to be rejected without ignore_above")
+	}
+}
@@ -0,0 +1,241 @@
+package elasticop
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+	"go.uber.org/zap"
+)
+
+// fakeTransitPrefix is the prefix of the ciphertexts of the fake Transit backend, which are the base64
+// encoded plaintexts, so tests can build and read them.
+const fakeTransitPrefix = "vault:v1:"
+
+// fakeKeyVersion matches the prefix of ciphertexts of any key version, which the fake Transit backend decrypts
+// like ciphertexts of the current key version.
+var fakeKeyVersion = regexp.MustCompile(`^vault:v[0-9]+:`)
+
+// fakeTransit emulates the encrypt, decrypt and rewrap operations and the key versions of Vault's Transit backend.
+type fakeTransit struct {
+	mu sync.Mutex
+
+	// failing lists the plaintexts whose encryption or decryption fails.
+	failing map[string]bool
+
+	// requests is the number of requests received.
+	requests int
+
+	// rejectBatches answers a batch with 400 Bad Request if any of its items fails, like Vault does,
+	// instead of reporting the failure in the result of the item.
+	rejectBatches bool
+}
+
+// fakeLatestKeyVersion is the latest version of the keys of the fake Transit backend, which rewrapped
+// ciphertexts are encrypted with.
+const fakeLatestKeyVersion = 2
+
+// withFakeTransit serves a fake Transit backend and makes the client use it as its Vault client.
+func withFakeTransit(t *testing.T, e *Elastic) *fakeTransit {
+	t.Helper()
+	transit := &fakeTransit{failing: map[string]bool{}}
+	server := httptest.NewServer(http.HandlerFunc(transit.serve))
+	t.Cleanup(server.Close)
+
+	client, err := vault.NewClient(&vault.Config{Address: server.URL})
+	if err != nil {
+		t.Fatalf("failed to create Vault client: %s", err)
+	}
+	client.SetToken("test")
+
+	e.Ctx = context.WithValue(e.Ctx, vaultop.VaultClientKey, &vaultop.Vault{
+		Client:      client,
+		Address:     server.URL,
+		TransitPath: "transit",
+		Logger:      zap.NewNop(),
+	})
+	return transit
+}
+
+// fail makes the encryption and decryption of the plaintext fail.
+func (f *fakeTransit) fail(plaintext string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failing[plaintext] = true
+}
+
+// fakeCiphertext returns the ciphertext the fake Transit backend produces for the plaintext.
+func fakeCiphertext(plaintext string) string {
+	return fakeTransitPrefix + base64.StdEncoding.EncodeToString([]byte(plaintext))
+}
+
+// fakePlaintext returns the plaintext of a ciphertext of the fake Transit backend.
+func fakePlaintext(t *testing.T, ciphertext string) string {
+	t.Helper()
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, fakeTransitPrefix))
+	if err != nil || !strings.HasPrefix(ciphertext, fakeTransitPrefix) {
+		t.Fatalf("invalid ciphertext %q", ciphertext)
+	}
+	return string(decoded)
+}
+
+// serve handles the single and batch requests sent to transit/encrypt/<key>, transit/decrypt/<key> and
+// transit/rewrap/<key>, and the reads of transit/keys/<key>.
+func (f *fakeTransit) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	if len(parts) == 2 && parts[0] == "keys" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"latest_version": fakeLatestKeyVersion},
+		})
+		return
+	}
+	if len(parts) != 2 || (parts[0] != "encrypt" && parts[0] != "decrypt" && parts[0] != "rewrap") {
+		http.Error(w, `{"errors":["unsupported path"]}`, http.StatusNotFound)
+		return
+	}
+
+	var body struct {
+		BatchInput []map[string]string `json:"batch_input"`
+		Plaintext  string              `json:"plaintext"`
+		Ciphertext string              `json:"ciphertext"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `{"errors":["invalid request"]}`, http.StatusBadRequest)
+		return
+	}
+
+	// A request without a batch is a single operation, answered with the result itself.
+	single := body.BatchInput == nil
+	if single {
+		body.BatchInput = []map[string]string{{"plaintext": body.Plaintext, "ciphertext": body.Ciphertext}}
+	}
+
+	results := make([]map[string]interface{}, 0, len(body.BatchInput))
+	failed := false
+	for _, item := range body.BatchInput {
+		encoded := item["plaintext"]
+		if parts[0] != "encrypt" {
+			encoded = fakeKeyVersion.ReplaceAllString(item["ciphertext"], "")
+		}
+		plaintext, err := base64.StdEncoding.DecodeString(encoded)
+		switch {
+		case err != nil:
+			results = append(results, map[string]interface{}{"error": "invalid input"})
+			failed = true
+		case f.failing[string(plaintext)]:
+			results = append(results, map[string]interface{}{"error": "operation failed"})
+			failed = true
+		case parts[0] == "encrypt":
+			results = append(results, map[string]interface{}{"ciphertext": fakeTransitPrefix + encoded})
+		case parts[0] == "rewrap":
+			results = append(results, map[string]interface{}{"ciphertext": "vault:v" + strconv.Itoa(fakeLatestKeyVersion) + ":" + encoded})
+		default:
+			results = append(results, map[string]interface{}{"plaintext": encoded})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if failed && f.rejectBatches && !single {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"one or more items failed"}})
+		return
+	}
+	if single {
+		if message, failed := results[0]["error"]; failed {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []interface{}{message}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": results[0]})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"data": map[string]interface{}{"batch_results": results},
+	})
+}
+
+func TestTransitBatchRejectedBatch(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	transit := withFakeTransit(t, e)
+	transit.rejectBatches = true
+	transit.fail("broken")
+	vault := e.Ctx.Value(vaultop.VaultClientKey).(*vaultop.Vault)
+	vault.TransitBatchSize = 3
+
+	// Only the item which failed gets an error, although Vault rejected its whole batch.
+	results, err := vault.EncryptBatchWithVault([]string{"first", "broken", "third", "fourth"}, "app")
+	if err != nil {
+		t.Fatalf("EncryptBatchWithVault failed: %s", err)
+	}
+	for i, expected := range []string{"first", "", "third", "fourth"} {
+		if expected == "" {
+			if results[i].Err == nil {
+				t.Errorf("expected item %d to fail", i)
+			}
+			continue
+		}
+		if results[i].Err != nil || results[i].Value != fakeCiphertext(expected) {
+			t.Errorf("expected item %d to be encrypted, got %+v", i, results[i])
+		}
+	}
+
+	// The rejected batch was sent again item by item, while the other batch succeeded at once.
+	if transit.requests != 5 {
+		t.Fatalf("expected 2 batches and 3 single requests, got %d requests", transit.requests)
+	}
+}
+
+func TestRewrapProjectRejectedBatch(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	transit := withFakeTransit(t, e)
+	transit.rejectBatches = true
+	transit.fail(`"broken"`)
+
+	broken := "tfb_string:" + fakeCiphertext(`"broken"`)
+	for id, attributes := range map[string]map[string]interface{}{
+		"first":  {"password": "tfb_string:" + fakeCiphertext(`"first"`)},
+		"second": {"password": "tfb_string:" + fakeCiphertext(`"second"`)},
+		"mixed":  {"password": "tfb_string:" + fakeCiphertext(`"mixed"`), "token": broken},
+		"broken": {"password": broken},
+	} {
+		cluster.put("terraform-resources", id, map[string]interface{}{
+			"project": "app", "workspace": DefaultWorkspace, "attributes": attributes,
+		})
+	}
+
+	// The documents with a value which can't be rewrapped are counted as failed, including the document
+	// none of whose values could be rewrapped, while the other documents of the rejected batch are rewrapped.
+	result, err := e.RewrapProject(nil)
+	if err != nil {
+		t.Fatalf("RewrapProject failed: %s", err)
+	}
+	if result.KeyVersion != fakeLatestKeyVersion || result.Documents != 4 || result.Updated != 2 || result.Values != 2 || result.Failed != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for _, id := range []string{"first", "second"} {
+		password := documentSource(t, cluster, "terraform-resources", id)["attributes"].(map[string]interface{})["password"]
+		if password != "tfb_string:"+rotatedCiphertext(`"`+id+`"`) {
+			t.Errorf("expected %s to be rewrapped, got %v", id, password)
+		}
+	}
+	mixed := documentSource(t, cluster, "terraform-resources", "mixed")["attributes"].(map[string]interface{})
+	if mixed["password"] != "tfb_string:"+fakeCiphertext(`"mixed"`) || mixed["token"] != broken {
+		t.Errorf("expected the failed document to be left as it was, got %v", mixed)
+	}
+}
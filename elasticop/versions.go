@@ -0,0 +1,233 @@
+package elasticop
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// StateVersion describes a committed version of the state in the version history.
+type StateVersion struct {
+	ID            string `json:"id"`
+	Serial        int64  `json:"serial"`
+	Lineage       string `json:"lineage"`
+	Timestamp     string `json:"timestamp"`
+	Author        string `json:"author,omitempty"`
+	ResourceCount *int64 `json:"resourceCount,omitempty"`
+	Size          *int64 `json:"size,omitempty"`
+	Deleted       bool   `json:"deleted,omitempty"`
+}
+
+// versionCursorKeepAlive is how long the point in time of a version listing is kept between two pages.
+const versionCursorKeepAlive = "5m"
+
+// ErrInvalidCursor is returned when the cursor of a version listing is malformed or has expired.
+var ErrInvalidCursor = errors.New("invalid or expired cursor")
+
+// versionCursor is the position of a version listing after a page, handed to the client as an opaque string.
+// The pages of a listing are read from the same point in time, so concurrent writes don't shift them.
+type versionCursor struct {
+	PIT   string        `json:"pit"`
+	After []interface{} `json:"after"`
+}
+
+// encodeVersionCursor returns the cursor as an opaque string.
+func encodeVersionCursor(cursor versionCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeVersionCursor parses a cursor returned by encodeVersionCursor.
+func decodeVersionCursor(s string) (versionCursor, error) {
+	var cursor versionCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor, ErrInvalidCursor
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&cursor); err != nil || cursor.PIT == "" || len(cursor.After) == 0 {
+		return cursor, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// ListVersions retrieves a page of the committed versions of the state, starting with the newest one.
+// The first page is read without a cursor; the following pages are read with the cursor returned by the
+// previous page, until no cursor is returned. Versions stored before their resource count and size were
+// recorded don't include them. It returns the versions of the page, the total number of versions and the
+// cursor of the next page. ErrInvalidCursor is returned if the cursor is malformed or has expired.
+func (e *Elastic) ListVersions(cursor string, size int) ([]StateVersion, int64, string, error) {
+	var buf bytes.Buffer
+
+	// Continue the listing at the cursor, or open a point in time for a new listing.
+	var position versionCursor
+	if cursor != "" {
+		var err error
+		if position, err = decodeVersionCursor(cursor); err != nil {
+			return nil, 0, "", err
+		}
+	} else {
+		pitID, err := e.openPointInTime(e.StateIndex)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		if pitID == "" {
+			// A missing state index means no state has been stored yet.
+			return []StateVersion{}, 0, "", nil
+		}
+		position.PIT = pitID
+	}
+
+	// Define Elasticsearch query to fetch the page of versions, newest first.
+	query := map[string]interface{}{
+		"query":            e.committedQuery(),
+		"size":             size,
+		"track_total_hits": true,
+		"_source":          []string{"serial", "lineage", "timestamp", "author", "resource_count", "size", "deleted"},
+		"pit": map[string]interface{}{
+			"id":         position.PIT,
+			"keep_alive": versionCursorKeepAlive,
+		},
+		"sort": []map[string]interface{}{
+			{"timestamp": map[string]interface{}{"order": "desc"}},
+			{"serial": map[string]interface{}{"order": "desc", "unmapped_type": "long"}},
+			{"_shard_doc": map[string]interface{}{"order": "desc"}},
+		},
+	}
+	if position.After != nil {
+		query["search_after"] = position.After
+	}
+
+	// Encode the Elasticsearch query
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		e.Logger.Error("Error encoding Elasticsearch query", zap.Error(err))
+		return nil, 0, "", fmt.Errorf("error encoding query: %s", err)
+	}
+
+	// Search Elasticsearch for the versions
+	res, err := e.Client.Search(
+		e.Client.Search.WithContext(e.Ctx),
+		e.Client.Search.WithBody(&buf),
+	)
+	if err != nil {
+		e.Logger.Error("Error getting Elasticsearch response", zap.Error(err))
+		return nil, 0, "", fmt.Errorf("error getting response: %s", err)
+	}
+	defer res.Body.Close()
+
+	// The point in time of a cursor expires when the next page isn't requested in time.
+	if res.StatusCode == http.StatusNotFound && cursor != "" {
+		e.Logger.Info("Version listing cursor expired", zap.String("project", e.Project))
+		return nil, 0, "", ErrInvalidCursor
+	}
+	if res.IsError() {
+		e.Logger.Error("Error searching the versions in Elasticsearch", zap.Int("status_code", res.StatusCode))
+		if cursor == "" {
+			e.closePointInTime(position.PIT)
+		}
+		return nil, 0, "", fmt.Errorf("error searching versions: %s", res.String())
+	}
+
+	// Parse response from the Elasticsearch
+	var r struct {
+		PitID string `json:"pit_id"`
+		Hits  struct {
+			Total struct {
+				Value int64 `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				ID     string `json:"_id"`
+				Source struct {
+					Serial        int64  `json:"serial"`
+					Lineage       string `json:"lineage"`
+					Timestamp     string `json:"timestamp"`
+					Author        string `json:"author"`
+					ResourceCount *int64 `json:"resource_count"`
+					Size          *int64 `json:"size"`
+					Deleted       bool   `json:"deleted"`
+				} `json:"_source"`
+				Sort []interface{} `json:"sort"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+	decoder := json.NewDecoder(res.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&r); err != nil {
+		e.Logger.Error("Error parsing the response from Elasticsearch", zap.Error(err))
+		return nil, 0, "", fmt.Errorf("error parsing Elasticsearch response: %s", err)
+	}
+
+	// The point in time ID may change between pages.
+	if r.PitID != "" {
+		position.PIT = r.PitID
+	}
+
+	versions := make([]StateVersion, 0, len(r.Hits.Hits))
+	for _, hit := range r.Hits.Hits {
+		versions = append(versions, StateVersion{
+			ID:            hit.ID,
+			Serial:        hit.Source.Serial,
+			Lineage:       hit.Source.Lineage,
+			Timestamp:     hit.Source.Timestamp,
+			Author:        hit.Source.Author,
+			ResourceCount: hit.Source.ResourceCount,
+			Size:          hit.Source.Size,
+			Deleted:       hit.Source.Deleted,
+		})
+		position.After = hit.Sort
+	}
+
+	// The last page is shorter than the page size, and ends the listing.
+	if len(r.Hits.Hits) < size {
+		e.closePointInTime(position.PIT)
+		return versions, r.Hits.Total.Value, "", nil
+	}
+
+	next, err := encodeVersionCursor(position)
+	if err != nil {
+		e.closePointInTime(position.PIT)
+		return nil, 0, "", err
+	}
+	return versions, r.Hits.Total.Value, next, nil
+}
+
+// GetVersion retrieves the committed version of the state with the given ID, including its resources.
+// It returns the reconstructed state as a JSON byte slice, decrypted like the current state.
+func (e *Elastic) GetVersion(id string) ([]byte, int, error) {
+	source, httpStatus, err := e.getVersionDocument(id)
+	if err != nil {
+		return nil, httpStatus, err
+	}
+
+	jsonData, err := e.renderState(source)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	e.Logger.Info("Successfully retrieved state version from Elasticsearch", zap.String("version", id), zap.String("project", e.Project))
+	return jsonData, http.StatusOK, nil
+}
+
+// getVersionDocument retrieves the source of the state document of the committed version with the given ID.
+// Versions which were never committed, and tombstones of deleted states, have no state and are not found.
+func (e *Elastic) getVersionDocument(id string) (map[string]interface{}, int, error) {
+	source, err := e.getStateDocument(id)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	if source == nil || source["committed"] == false || source["deleted"] == true {
+		e.Logger.Info("State version not found", zap.String("project", e.Project), zap.String("version", id))
+		return nil, http.StatusNotFound, fmt.Errorf("state version %s not found", id)
+	}
+	return source, http.StatusOK, nil
+}
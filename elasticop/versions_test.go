@@ -0,0 +1,112 @@
+package elasticop
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestListVersionsPagesWithCursor(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	// Versions written within the same second share their timestamp, and some of them even their serial.
+	const total = 25
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < total; i++ {
+		cluster.put("terraform-state", fmt.Sprintf("version-%02d", i), map[string]interface{}{
+			"project": "app", "workspace": DefaultWorkspace, "committed": true,
+			"timestamp": start.Add(time.Duration(i/4) * time.Second).Format(time.RFC3339), "serial": i / 2,
+		})
+	}
+	cluster.put("terraform-state", "uncommitted", map[string]interface{}{
+		"project": "app", "workspace": DefaultWorkspace, "committed": false, "timestamp": start.Add(time.Hour).Format(time.RFC3339),
+	})
+	cluster.put("terraform-state", "other", map[string]interface{}{
+		"project": "app", "workspace": "staging", "committed": true, "timestamp": start.Format(time.RFC3339),
+	})
+
+	// Every version is listed exactly once, newest first, across the pages.
+	seen := map[string]bool{}
+	var listed []StateVersion
+	cursor := ""
+	pages := 0
+	for {
+		versions, count, next, err := e.ListVersions(cursor, 10)
+		if err != nil {
+			t.Fatalf("ListVersions failed: %s", err)
+		}
+		if count != total {
+			t.Fatalf("expected a total of %d versions, got %d", total, count)
+		}
+		for _, version := range versions {
+			if seen[version.ID] {
+				t.Fatalf("version %s was listed twice", version.ID)
+			}
+			seen[version.ID] = true
+		}
+		listed = append(listed, versions...)
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(listed) != total || pages != 3 {
+		t.Fatalf("expected %d versions in 3 pages, got %d in %d", total, len(listed), pages)
+	}
+	for i := 1; i < len(listed); i++ {
+		previous, current := listed[i-1], listed[i]
+		if previous.Timestamp < current.Timestamp || (previous.Timestamp == current.Timestamp && previous.Serial < current.Serial) {
+			t.Fatalf("expected the versions newest first, got %s before %s", previous.ID, current.ID)
+		}
+	}
+
+	// The pages were read from the same point in time, which is closed after the last page.
+	if cluster.stalePIT != 0 {
+		t.Fatalf("expected no searches with an outdated point in time ID, got %d", cluster.stalePIT)
+	}
+	if open := cluster.openPITs(); open != 0 {
+		t.Fatalf("expected the point in time to be closed, got %d open", open)
+	}
+}
+
+func TestListVersionsInvalidCursor(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+	for i := 0; i < 3; i++ {
+		cluster.put("terraform-state", "", map[string]interface{}{
+			"project": "app", "workspace": DefaultWorkspace, "timestamp": fmt.Sprintf("2024-01-0%dT00:00:00Z", i+1),
+		})
+	}
+
+	// A malformed cursor is rejected.
+	if _, _, _, err := e.ListVersions("not a cursor", 1); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected ErrInvalidCursor for a malformed cursor, got %v", err)
+	}
+
+	// A cursor whose point in time is gone has expired.
+	_, _, next, err := e.ListVersions("", 1)
+	if err != nil || next == "" {
+		t.Fatalf("expected a cursor for the next page, got %q (%v)", next, err)
+	}
+	cursor, err := decodeVersionCursor(next)
+	if err != nil {
+		t.Fatalf("expected the cursor to be valid, got %v", err)
+	}
+	e.closePointInTime(cursor.PIT)
+	if _, _, _, err := e.ListVersions(next, 1); !errors.Is(err, ErrInvalidCursor) {
+		t.Fatalf("expected ErrInvalidCursor for an expired cursor, got %v", err)
+	}
+}
+
+func TestListVersionsMissingIndex(t *testing.T) {
+	_, server := newFakeCluster(t)
+	e := newTestElastic(t, server, "app", DefaultWorkspace)
+
+	versions, total, next, err := e.ListVersions("", 10)
+	if err != nil || len(versions) != 0 || total != 0 || next != "" {
+		t.Fatalf("expected no versions without an index, got %d of %d, next %q (%v)", len(versions), total, next, err)
+	}
+}
@@ -22,6 +22,14 @@ func main() {
 	// Log the configuration file path being used
 	logger.Info("Using configuration file", zap.String("path", configFilePath))
 
+	// Run the command given on the command line instead of the server
+	if flag.NArg() > 0 {
+		if err := server.RunCommand(configFilePath, flag.Args(), logger); err != nil {
+			logger.Fatal("Command failed", zap.String("command", flag.Arg(0)), zap.Error(err))
+		}
+		return
+	}
+
 	// Start the HTTP server
 	if err := server.ServeHttp(configFilePath, logger); err != nil {
 		logger.Fatal("Failed to start HTTP server", zap.Error(err))
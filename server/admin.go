@@ -0,0 +1,400 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/levente-simon/terraform-elastic-backend/elasticop"
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+	"go.uber.org/zap"
+)
+
+// lockSummary describes an active lock in the lock listing of the administrative API.
+type lockSummary struct {
+	Project    string     `json:"project"`
+	Workspace  string     `json:"workspace"`
+	ID         string     `json:"id"`
+	Holder     string     `json:"holder"`
+	Operation  string     `json:"operation"`
+	LockedBy   string     `json:"lockedBy"`
+	Created    time.Time  `json:"created"`
+	AgeSeconds int64      `json:"ageSeconds"`
+	Expires    *time.Time `json:"expires,omitempty"`
+	Expired    bool       `json:"expired"`
+}
+
+// forceUnlockRequest is the body of a force-unlock request.
+type forceUnlockRequest struct {
+	Reason string `json:"reason"`
+}
+
+// rollbackRequest is the body of a rollback request.
+type rollbackRequest struct {
+	Version string `json:"version"`
+	Reason  string `json:"reason"`
+}
+
+// encryptionRules describes the encryption rules which apply to a project. The exclude patterns of the
+// project are the only ones, so they are also the effective exclude patterns.
+type encryptionRules struct {
+	Global           []string `json:"global"`
+	ProjectInclude   []string `json:"projectInclude"`
+	ProjectExclude   []string `json:"projectExclude"`
+	Include          []string `json:"include"`
+	EncryptSensitive bool     `json:"encryptSensitive"`
+	EncryptRawState  bool     `json:"encryptRawState"`
+}
+
+// listLocksHandler lists the active locks stored in the lock index of the project, which includes the locks
+// of every project sharing the same index. Expired locks are included with the expired query parameter.
+func listLocksHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	locks, err := e.ListLocks(queryBool(r, "expired"))
+	if err != nil {
+		logger.Error("Failed to list locks", zap.Error(err))
+		http.Error(w, "Failed to list locks", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, lockSummaries(locks))
+}
+
+// listAllLocksHandler lists the active locks of all projects configured in Vault which the caller can read.
+// Lock indices shared by several projects are only listed once. Expired locks are included with the
+// expired query parameter.
+func listAllLocksHandler(w http.ResponseWriter, r *http.Request) {
+	vaultClient := r.Context().Value(vaultop.VaultClientKey).(*vaultop.Vault)
+	projects, err := vaultClient.ListProjects()
+	if err != nil {
+		logger.Error("Failed to list projects", zap.Error(err))
+		http.Error(w, "Failed to list projects", http.StatusInternalServerError)
+		return
+	}
+
+	includeExpired := queryBool(r, "expired")
+	listed := map[string]bool{}
+	locks := []elasticop.ESDistributedLock{}
+	for _, project := range projects {
+		e, err := newElastic(r.Context(), project, "")
+		if err != nil {
+			// Projects the caller can't read, or whose cluster is unavailable, are skipped.
+			logger.Warn("Skipping project while listing locks", zap.String("project", project), zap.Error(err))
+			continue
+		}
+
+		// List each lock index of each cluster once.
+		key := strings.Join(e.Addresses, ",") + "|" + e.CloudID + "|" + e.LockIndex
+		if listed[key] {
+			continue
+		}
+		listed[key] = true
+
+		projectLocks, err := e.ListLocks(includeExpired)
+		if err != nil {
+			logger.Error("Failed to list locks", zap.String("project", project), zap.Error(err))
+			http.Error(w, "Failed to list locks", http.StatusInternalServerError)
+			return
+		}
+		locks = append(locks, projectLocks...)
+	}
+
+	// List the locks of all indices oldest first.
+	sort.SliceStable(locks, func(i, j int) bool { return locks[i].Created.Before(locks[j].Created) })
+	writeJSON(w, http.StatusOK, lockSummaries(locks))
+}
+
+// lockSummaries summarizes the locks with their holder, operation and age.
+func lockSummaries(locks []elasticop.ESDistributedLock) []lockSummary {
+	now := time.Now()
+	summaries := make([]lockSummary, 0, len(locks))
+	for _, lock := range locks {
+		workspace := lock.Workspace
+		if workspace == "" {
+			workspace = elasticop.DefaultWorkspace
+		}
+		summaries = append(summaries, lockSummary{
+			Project:    lock.Project,
+			Workspace:  workspace,
+			ID:         lock.Info.ID,
+			Holder:     lock.Info.Who,
+			Operation:  lock.Info.Operation,
+			LockedBy:   lock.LockedBy,
+			Created:    lock.Created,
+			AgeSeconds: int64(now.Sub(lock.Created).Seconds()),
+			Expires:    lock.Expires,
+			Expired:    lock.Expired(),
+		})
+	}
+	return summaries
+}
+
+// queryBool reports whether the boolean query parameter is set to a true value.
+func queryBool(r *http.Request, name string) bool {
+	value, err := strconv.ParseBool(r.URL.Query().Get(name))
+	return err == nil && value
+}
+
+// forceUnlockHandler releases the lock of the project and workspace regardless of its holder.
+// A reason is mandatory and is written to the audit index together with the lock before it is released.
+func forceUnlockHandler(w http.ResponseWriter, r *http.Request) {
+	var req forceUnlockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "A reason is required to force-unlock", http.StatusBadRequest)
+		return
+	}
+
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	lock, err := e.GetLock()
+	if err != nil {
+		logger.Error("Failed to check the lock", zap.Error(err))
+		http.Error(w, "Failed to release lock", http.StatusInternalServerError)
+		return
+	}
+	if lock == nil {
+		http.Error(w, "Failed to release lock, lock does not exist", http.StatusNotFound)
+		return
+	}
+
+	// Record who releases the lock and why before releasing it.
+	user := requestUser(r)
+	details := map[string]interface{}{"lock": lock}
+	if err := e.WriteAudit("force-unlock", user, req.Reason, details); err != nil {
+		logger.Error("Failed to write audit record", zap.Error(err))
+		http.Error(w, "Failed to release lock, the audit record could not be written", http.StatusInternalServerError)
+		return
+	}
+
+	released, err := e.ForceReleaseLock(lock)
+	if errors.Is(err, elasticop.ErrLockChanged) {
+		http.Error(w, "Failed to release lock, lock was changed concurrently", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to release lock", zap.Error(err))
+		http.Error(w, "Failed to release lock", http.StatusInternalServerError)
+		return
+	}
+	if !released {
+		http.Error(w, "Failed to release lock, lock does not exist", http.StatusNotFound)
+		return
+	}
+
+	notifyLockReleased(lockQueueKey(e))
+	logger.Warn("Lock force-released", zap.String("user", user), zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.String("lock_id", lock.Info.ID), zap.String("reason", req.Reason))
+	writeJSON(w, http.StatusOK, lock.Info)
+}
+
+// rollbackHandler makes a previous version of the state the current state again, as a new version.
+// The project must be unlocked, or locked by the caller identified by the ID query parameter. An unlocked
+// project is locked for the duration of the rollback, so no state can be written concurrently.
+// The rollback is recorded in the audit index with the user and the reason before the state is changed.
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	var req rollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version == "" {
+		http.Error(w, "The version to roll back to is required", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, "A reason is required to roll back", http.StatusBadRequest)
+		return
+	}
+
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	lock, err := e.GetLock()
+	if err != nil {
+		logger.Error("Failed to check the lock", zap.Error(err))
+		http.Error(w, "Failed to check the lock", http.StatusInternalServerError)
+		return
+	}
+	if lock != nil && lock.Info.ID != r.URL.Query().Get("ID") {
+		logger.Warn("Refusing to roll back state, project is locked by another client", zap.String("project", e.Project), zap.String("lock_id", lock.Info.ID))
+		writeLockInfo(w, http.StatusLocked, lock)
+		return
+	}
+
+	// Lock the unlocked project for the rollback, so no other client can lock it and write in the meantime.
+	user := requestUser(r)
+	if lock == nil {
+		lockID, held, httpStatus, err := lockForRollback(e, r, user)
+		if err != nil {
+			http.Error(w, err.Error(), httpStatus)
+			return
+		}
+		if held != nil {
+			logger.Warn("Refusing to roll back state, project was locked concurrently", zap.String("project", e.Project), zap.String("lock_id", held.Info.ID))
+			writeLockInfo(w, http.StatusLocked, held)
+			return
+		}
+		defer unlockAfterRollback(e, lockID)
+	}
+
+	// Record who rolls back the state and why before rolling it back.
+	details := map[string]interface{}{"from_version": req.Version}
+	if err := e.WriteAudit("rollback", user, req.Reason, details); err != nil {
+		logger.Error("Failed to write audit record", zap.Error(err))
+		http.Error(w, "Failed to roll back state, the audit record could not be written", http.StatusInternalServerError)
+		return
+	}
+
+	version, httpStatus, err := e.RollbackState(req.Version)
+	if err != nil {
+		logger.Error("Failed to roll back state", zap.String("version", req.Version), zap.Error(err))
+		http.Error(w, err.Error(), httpStatus)
+		return
+	}
+
+	logger.Warn("State rolled back", zap.String("user", user), zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.String("version", req.Version), zap.String("new_version", version.ID), zap.String("reason", req.Reason))
+	writeJSON(w, http.StatusOK, version)
+}
+
+// lockForRollback locks the project and workspace on behalf of the user rolling back the state, and returns
+// the ID of the lock. It returns the holder instead if another client locked it first, and an error with
+// http.StatusConflict if the lock kept changing, so there is no holder to report.
+func lockForRollback(e *elasticop.Elastic, r *http.Request, user string) (string, *elasticop.ESDistributedLock, int, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		logger.Error("Failed to generate lock ID", zap.Error(err))
+		return "", nil, http.StatusInternalServerError, fmt.Errorf("failed to generate lock ID: %s", err)
+	}
+
+	info := elasticop.LockInfo{ID: hex.EncodeToString(id), Operation: "rollback", Who: user, Created: time.Now().UTC()}
+	acquired, holder, err := e.AcquireLock(r.RemoteAddr, info)
+	if err != nil {
+		logger.Error("Failed to lock the state for the rollback", zap.Error(err))
+		return "", nil, http.StatusInternalServerError, fmt.Errorf("failed to lock the state: %s", err)
+	}
+	if !acquired {
+		if holder == nil {
+			// The lock kept changing while it was acquired, so the state is being locked and written concurrently.
+			logger.Warn("Refusing to roll back state, lock kept changing", zap.String("project", e.Project))
+			return "", nil, http.StatusConflict, fmt.Errorf("failed to lock the state, it is being locked concurrently")
+		}
+		return "", holder, http.StatusLocked, nil
+	}
+	return info.ID, nil, http.StatusOK, nil
+}
+
+// unlockAfterRollback releases the lock taken for the rollback, unless it was force-released and locked by
+// another client since, and lets the next waiting request retry.
+func unlockAfterRollback(e *elasticop.Elastic, lockID string) {
+	lock, err := e.GetLock()
+	if err != nil {
+		logger.Error("Failed to check the lock taken for the rollback", zap.String("project", e.Project), zap.Error(err))
+		return
+	}
+	if lock == nil || lock.Info.ID != lockID {
+		return
+	}
+	if _, err := e.ReleaseLock(lock); err != nil {
+		logger.Error("Failed to release the lock taken for the rollback", zap.String("project", e.Project), zap.Error(err))
+		return
+	}
+	notifyLockReleased(lockQueueKey(e))
+}
+
+// encryptionRulesHandler shows the encryption rules of the project: the global patterns, the include and
+// exclude patterns of the project, and the effective include patterns they result in.
+func encryptionRulesHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	EncryptionRules(w, r, e)
+}
+
+// EncryptionRules writes the encryption rules of the project.
+func EncryptionRules(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
+	rules := encryptionRules{
+		Global:           nonEmpty(config.Encrypt),
+		ProjectInclude:   nonEmpty(e.EncryptInclude),
+		ProjectExclude:   nonEmpty(e.EncryptExclude),
+		Include:          []string{},
+		EncryptSensitive: e.EncryptSensitive,
+		EncryptRawState:  e.RawStateEncrypted(),
+	}
+	for _, re := range e.Encrypt {
+		rules.Include = append(rules.Include, re.String())
+	}
+
+	writeJSON(w, http.StatusOK, rules)
+}
+
+// rewrapHandler rewraps the encrypted values of all versions of the project with the latest version of its
+// Transit key. The progress is streamed as one JSON object per line, followed by the result, or an object
+// with the error if the rewrap fails midway. An interrupted rewrap is resumed by sending the request again.
+func rewrapHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	// Stream each progress report as soon as it is available.
+	progress := func(p elasticop.RewrapProgress) {
+		if err := encoder.Encode(p); err != nil {
+			logger.Warn("Failed to write the rewrap progress", zap.Error(err))
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	user := requestUser(r)
+	result, err := e.RewrapProject(progress)
+	if err != nil {
+		logger.Error("Failed to rewrap project", zap.String("project", e.Project), zap.Error(err))
+		encoder.Encode(map[string]interface{}{"error": err.Error(), "progress": result})
+		return
+	}
+
+	// Record who rewrapped the project.
+	details := map[string]interface{}{"result": result}
+	if err := e.WriteAudit("rewrap", user, "", details); err != nil {
+		logger.Error("Failed to write audit record", zap.Error(err))
+	}
+
+	logger.Info("Project rewrapped", zap.String("user", user), zap.String("project", e.Project), zap.Int("key_version", result.KeyVersion))
+	encoder.Encode(map[string]interface{}{"result": result})
+}
+
+// nonEmpty returns the patterns without the empty ones, as an empty list rather than nil.
+func nonEmpty(patterns []string) []string {
+	result := []string{}
+	for _, pattern := range patterns {
+		if strings.TrimSpace(pattern) != "" {
+			result = append(result, pattern)
+		}
+	}
+	return result
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestEncryptionRules(t *testing.T) {
+	e, fake := newHandlerTest(t, "app", "admin")
+	config.Encrypt = []string{"password$", " "}
+	e.EncryptInclude = []string{"token$", ""}
+	e.EncryptExclude = []string{"^outputs"}
+	e.Encrypt = []*regexp.Regexp{regexp.MustCompile("password$"), regexp.MustCompile("token$")}
+	e.EncryptSensitive = true
+
+	w := httptest.NewRecorder()
+	EncryptionRules(w, httptest.NewRequest("GET", "/admin/app/encryption", nil), e)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the rules to be shown, got %d: %s", w.Code, w.Body)
+	}
+
+	// The blank patterns are left out, and the exclude patterns of the project are only listed once.
+	var rules map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &rules); err != nil {
+		t.Fatalf("failed to parse the response: %s", err)
+	}
+	expected := map[string]interface{}{
+		"global":           []interface{}{"password$"},
+		"projectInclude":   []interface{}{"token$"},
+		"projectExclude":   []interface{}{"^outputs"},
+		"include":          []interface{}{"password$", "token$"},
+		"encryptSensitive": true,
+		"encryptRawState":  true,
+	}
+	if !reflect.DeepEqual(rules, expected) {
+		t.Fatalf("unexpected rules\n got: %v\nwant: %v", rules, expected)
+	}
+	if fake.requests != 0 {
+		t.Fatalf("expected no requests to Elasticsearch, got %d", fake.requests)
+	}
+}
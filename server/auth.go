@@ -10,19 +10,38 @@ import (
 	"go.uber.org/zap"
 )
 
+// contextKey is a custom type used to define keys for context values set by the server.
+type contextKey string
+
+// userContextKey is a context key used to store and retrieve the authenticated user name.
+const userContextKey contextKey = "user"
+
+// requestUser returns the name of the user who authenticated the request.
+func requestUser(r *http.Request) string {
+	user, _ := r.Context().Value(userContextKey).(string)
+	return user
+}
+
+// newVaultClient initializes a Vault client based on the configuration.
+func newVaultClient() *vaultop.Vault {
+	return &vaultop.Vault{
+		Address:            config.Vault.Address,
+		CaCertPath:         config.Vault.CACertPath,
+		Insecure:           config.Vault.Insecure,
+		KvMountPath:        config.Vault.KvMountPath,
+		TransitPath:        config.Vault.TransitPath,
+		TransitBatchSize:   config.Vault.TransitBatchSize,
+		TransitParallelism: config.Vault.TransitParallelism,
+		Logger:             logger,
+	}
+}
+
 // basicAuth is a middleware that wraps the provided http.HandlerFunc with Basic Authentication
 // using Vault to verify the credentials.
 func basicAuth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Initialize the vault client outside of the function
-		var vaultClient = &vaultop.Vault{
-			Address:     config.Vault.Address,
-			CaCertPath:  config.Vault.CACertPath,
-			Insecure:    config.Vault.Insecure,
-			KvMountPath: config.Vault.KvMountPath,
-			TransitPath: config.Vault.TransitPath,
-			Logger:      logger,
-		}
+		// Initialize a vault client for the request
+		var vaultClient = newVaultClient()
 
 		// Retrieve the Authorization header value
 		auth := r.Header.Get("Authorization")
@@ -58,8 +77,33 @@ func basicAuth(handler http.HandlerFunc) http.HandlerFunc {
 
 		logger.Info("Authorized request", zap.String("user", authData[0]), zap.String("remote_addr", r.RemoteAddr))
 
-		// Add the vault client to the request context and invoke the original handler
+		// Add the vault client and the user to the request context and invoke the original handler
 		ctx := context.WithValue(r.Context(), vaultop.VaultClientKey, vaultClient)
+		ctx = context.WithValue(ctx, userContextKey, authData[0])
 		handler(w, r.WithContext(ctx))
 	}
 }
+
+// isAdmin reports whether the user is listed as an administrator in the configuration.
+func isAdmin(user string) bool {
+	for _, admin := range config.Admin.Users {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// adminAuth is a middleware that authenticates the request with basicAuth
+// and only lets administrators through to the provided handler.
+func adminAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return basicAuth(func(w http.ResponseWriter, r *http.Request) {
+		user := requestUser(r)
+		if !isAdmin(user) {
+			logger.Warn("Administrative access denied", zap.String("user", user), zap.String("path", r.URL.Path))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	})
+}
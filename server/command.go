@@ -0,0 +1,227 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/levente-simon/terraform-elastic-backend/elasticop"
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+	"go.uber.org/zap"
+)
+
+// commandFlags holds the flags shared by the commands operating on the state of a project.
+type commandFlags struct {
+	project   string
+	workspace string
+	username  string
+	password  string
+}
+
+// register defines the shared flags on the flag set.
+// The Vault credentials default to the TFB_USERNAME and TFB_PASSWORD environment variables.
+func (c *commandFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&c.project, "project", "", "Name of the project")
+	fs.StringVar(&c.workspace, "workspace", elasticop.DefaultWorkspace, "Name of the workspace")
+	fs.StringVar(&c.username, "username", os.Getenv("TFB_USERNAME"), "Vault username")
+	fs.StringVar(&c.password, "password", os.Getenv("TFB_PASSWORD"), "Vault password")
+}
+
+// connect authenticates with Vault and connects to the Elasticsearch cluster of the project.
+func (c *commandFlags) connect() (*elasticop.Elastic, error) {
+	if c.project == "" {
+		return nil, fmt.Errorf("the -project flag is required")
+	}
+
+	vaultClient := newVaultClient()
+	isAuthenticated, err := vaultClient.BasicAuth(c.username, c.password, config.Vault.UserPassPath)
+	if err != nil || !isAuthenticated {
+		return nil, fmt.Errorf("failed to authenticate with Vault: %v", err)
+	}
+
+	ctx := context.WithValue(context.Background(), vaultop.VaultClientKey, vaultClient)
+	ctx = context.WithValue(ctx, userContextKey, c.username)
+	return newElastic(ctx, c.project, c.workspace)
+}
+
+// RunCommand runs the command given on the command line instead of starting the server.
+func RunCommand(configFilePath string, args []string, loggerArg *zap.Logger) error {
+	logger = loggerArg // Assign passed logger
+
+	err := config.readConfig(configFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %v", err)
+	}
+
+	switch args[0] {
+	case "migrate":
+		return migrateCommand(args[1:])
+	case "prune":
+		return pruneCommand(args[1:])
+	case "bootstrap":
+		return bootstrapCommand(args[1:])
+	case "rewrap":
+		return rewrapCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// migrateCommand tags the state and resource documents stored before states were scoped to projects
+// with the given project and workspace. With -retype, the values of the project encrypted before the JSON type
+// of values was recorded are also converted to the typed envelope, restoring the types of the attributes
+// declared by the provider schemas given with -schema.
+func migrateCommand(args []string) error {
+	var flags commandFlags
+	var retype bool
+	var schemaPath string
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.register(fs)
+	fs.BoolVar(&retype, "retype", false, "Convert the values encrypted before their JSON type was recorded")
+	fs.StringVar(&schemaPath, "schema", "", "Path of the provider schemas printed by terraform providers schema -json, declaring the attribute types to restore")
+	fs.Parse(args)
+
+	// Read the provider schemas before changing anything.
+	var schemas elasticop.ProviderSchemas
+	if schemaPath != "" {
+		data, err := os.ReadFile(schemaPath)
+		if err != nil {
+			return fmt.Errorf("failed to read provider schemas: %v", err)
+		}
+		if schemas, err = elasticop.ParseProviderSchemas(data); err != nil {
+			return err
+		}
+	}
+
+	e, err := flags.connect()
+	if err != nil {
+		return err
+	}
+
+	updated, err := e.BackfillProject()
+	if err != nil {
+		return fmt.Errorf("failed to migrate documents: %v", err)
+	}
+
+	fmt.Printf("Tagged %d documents with project %q and workspace %q\n", updated, e.Project, e.Workspace)
+	if !retype {
+		return nil
+	}
+
+	result, err := e.RetypeLegacyValues(schemas)
+	if err != nil {
+		return fmt.Errorf("failed to convert encrypted values: %v", err)
+	}
+
+	fmt.Printf("Converted %d encrypted values in %d of %d documents, %d kept as strings\n", result.Values, result.Updated, result.Documents, result.Strings)
+	if result.Conflicts > 0 || result.Failed > 0 {
+		return fmt.Errorf("%d documents changed concurrently and %d failed, run the command again to convert them", result.Conflicts, result.Failed)
+	}
+	return nil
+}
+
+// pruneCommand removes the versions of the state which are not kept by the retention policy of the project.
+// With -dry-run, the versions are only listed.
+func pruneCommand(args []string) error {
+	var flags commandFlags
+	var dryRun bool
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	flags.register(fs)
+	fs.BoolVar(&dryRun, "dry-run", false, "List the versions to remove without removing them")
+	fs.Parse(args)
+
+	e, err := flags.connect()
+	if err != nil {
+		return err
+	}
+	if !e.RetentionEnabled() {
+		return fmt.Errorf("no retention policy is configured for project %q", e.Project)
+	}
+
+	pruned, err := e.PruneVersions(dryRun)
+	for _, version := range pruned {
+		if dryRun {
+			fmt.Printf("Would remove version %s from %s\n", version.ID, version.Timestamp)
+		} else {
+			fmt.Printf("Removed version %s from %s\n", version.ID, version.Timestamp)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to prune versions: %v", err)
+	}
+
+	if dryRun {
+		fmt.Printf("%d versions would be removed\n", len(pruned))
+	} else {
+		fmt.Printf("Removed %d versions\n", len(pruned))
+	}
+	return nil
+}
+
+// bootstrapCommand installs the index templates and creates the indices of the project,
+// then reports any remaining problem with the mappings.
+func bootstrapCommand(args []string) error {
+	var flags commandFlags
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	flags.register(fs)
+	fs.Parse(args)
+
+	e, err := flags.connect()
+	if err != nil {
+		return err
+	}
+
+	if err := e.Bootstrap(); err != nil {
+		return fmt.Errorf("failed to bootstrap indices: %v", err)
+	}
+
+	problems, err := e.VerifyTemplates()
+	if err != nil {
+		return fmt.Errorf("failed to verify index templates: %v", err)
+	}
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%d problems found with the indices", len(problems))
+	}
+
+	fmt.Println("Index templates and indices are up to date")
+	return nil
+}
+
+// rewrapCommand rewraps the encrypted values of all versions of the project with the latest version of its
+// Transit key, printing the progress. An interrupted rewrap is resumed by running the command again.
+func rewrapCommand(args []string) error {
+	var flags commandFlags
+	fs := flag.NewFlagSet("rewrap", flag.ExitOnError)
+	flags.register(fs)
+	fs.Parse(args)
+
+	e, err := flags.connect()
+	if err != nil {
+		return err
+	}
+
+	progress := func(p elasticop.RewrapProgress) {
+		fmt.Printf("%s: checked %d documents, updated %d, rewrapped %d values, %d conflicts, %d failed\n",
+			p.Index, p.Documents, p.Updated, p.Values, p.Conflicts, p.Failed)
+	}
+	result, err := e.RewrapProject(progress)
+	if err != nil {
+		return fmt.Errorf("failed to rewrap project: %v", err)
+	}
+
+	// Record the rewrap in the audit index.
+	details := map[string]interface{}{"result": result}
+	if err := e.WriteAudit("rewrap", flags.username, "", details); err != nil {
+		logger.Error("Failed to write audit record", zap.Error(err))
+	}
+
+	if result.Conflicts > 0 || result.Failed > 0 {
+		return fmt.Errorf("%d documents were not rewrapped to key version %d, run the command again to retry them", result.Conflicts+result.Failed, result.KeyVersion)
+	}
+	fmt.Printf("Rewrapped %d values in %d documents to key version %d\n", result.Values, result.Updated, result.KeyVersion)
+	return nil
+}
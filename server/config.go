@@ -1,7 +1,9 @@
 package server
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	"go.uber.org/zap"
 	"gopkg.in/yaml.v2"
@@ -11,7 +13,9 @@ import (
 type Config struct {
 	// Configuration for Elasticsearch.
 	Elasticsearch struct {
-		CaCertPath string `yaml:"ca_cert_path"`
+		CaCertPath     string `yaml:"ca_cert_path"`
+		BulkBatchSize  int    `yaml:"bulk_batch_size"`
+		BulkFlushBytes int    `yaml:"bulk_flush_bytes"`
 	} `yaml:"elasticsearch"`
 
 	// Configuration for HTTP/HTTPS servers.
@@ -26,20 +30,47 @@ type Config struct {
 
 	// Configuration for Vault.
 	Vault struct {
-		Address      string `yaml:"address"`
-		CACertPath   string `yaml:"ca_cert_path"`
-		Insecure     bool   `yaml:"insecure"`
-		UserPassPath string `yaml:"userpass_path"`
-		KvMountPath  string `yaml:"kv_mount_path"`
-		TransitPath  string `yaml:"transit_path"`
+		Address            string `yaml:"address"`
+		CACertPath         string `yaml:"ca_cert_path"`
+		Insecure           bool   `yaml:"insecure"`
+		UserPassPath       string `yaml:"userpass_path"`
+		KvMountPath        string `yaml:"kv_mount_path"`
+		TransitPath        string `yaml:"transit_path"`
+		TransitBatchSize   int    `yaml:"transit_batch_size"`
+		TransitParallelism int    `yaml:"transit_parallelism"`
 	} `yaml:"vault"`
 
+	// Configuration for lock acquisition.
+	Lock struct {
+		MaxWait      time.Duration `yaml:"max_wait"`
+		PollInterval time.Duration `yaml:"poll_interval"`
+	} `yaml:"lock"`
+
+	// Configuration for pruning old state versions.
+	// The Vault credentials are used by the background sweep to list the projects.
+	Retention struct {
+		Background bool          `yaml:"background"`
+		Interval   time.Duration `yaml:"interval"`
+		Username   string        `yaml:"username"`
+		Password   string        `yaml:"password"`
+	} `yaml:"retention"`
+
+	// Configuration for the administrative API.
+	Admin struct {
+		Users []string `yaml:"users"`
+	} `yaml:"admin"`
+
 	// List of fields or configurations to encrypt.
 	Encrypt []string `yaml:"encrypt"`
+
+	// Encrypt the values Terraform flags as sensitive, in addition to the fields matching the patterns.
+	EncryptSensitive bool `yaml:"encrypt_sensitive"`
 }
 
 // setDefaultValues initializes the configuration with default values.
 func (c *Config) setDefaultValues() {
+	c.Elasticsearch.BulkBatchSize = 500
+	c.Elasticsearch.BulkFlushBytes = 5 * 1024 * 1024
 	c.HttpServer.HttpEnabled = true
 	c.HttpServer.HttpAddress = ":8080"
 	c.HttpServer.HttpsEnabled = false
@@ -51,6 +82,28 @@ func (c *Config) setDefaultValues() {
 	c.Vault.UserPassPath = "userpass"
 	c.Vault.TransitPath = "transit"
 	c.Vault.KvMountPath = "kv"
+	c.Vault.TransitBatchSize = 100
+	c.Vault.TransitParallelism = 4
+	c.Lock.MaxWait = 5 * time.Minute
+	c.Lock.PollInterval = 2 * time.Second
+	c.Retention.Background = true
+	c.Retention.Interval = time.Hour
+	c.Retention.Username = os.Getenv("TFB_USERNAME")
+	c.Retention.Password = os.Getenv("TFB_PASSWORD")
+}
+
+// validate checks the configuration values which have to be within bounds.
+func (c *Config) validate() error {
+	if c.Lock.PollInterval <= 0 {
+		return fmt.Errorf("lock.poll_interval must be positive, got %s", c.Lock.PollInterval)
+	}
+	if c.Lock.MaxWait < 0 {
+		return fmt.Errorf("lock.max_wait must not be negative, got %s", c.Lock.MaxWait)
+	}
+	if c.Retention.Background && c.Retention.Interval <= 0 {
+		return fmt.Errorf("retention.interval must be positive, got %s", c.Retention.Interval)
+	}
+	return nil
 }
 
 // readConfig reads the configuration from a given file path.
@@ -77,6 +130,11 @@ func (c *Config) readConfig(configFilePath string) error {
 		return err
 	}
 
+	// Reject values which can't be used.
+	if err := c.validate(); err != nil {
+		return err
+	}
+
 	// Log successful configuration load.
 	logger.Info("Configuration loaded from file", zap.String("path", configFilePath))
 	return nil
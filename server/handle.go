@@ -1,6 +1,9 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"regexp"
@@ -10,29 +13,53 @@ import (
 	"go.uber.org/zap"
 )
 
-// stateHandler is the main handler for managing terraform state in Elasticsearch.
-func stateHandler(w http.ResponseWriter, r *http.Request) {
-
-	v := mux.Vars(r)
-
+// newElastic initializes the Elasticsearch client for the project and workspace and connects to the cluster.
+// The context must carry the authenticated Vault client, and the user recorded as the author of changes.
+func newElastic(ctx context.Context, project, workspace string) (*elasticop.Elastic, error) {
 	// Compile the regular expressions from config for fields to encrypt.
 	compiledRegex := make([]*regexp.Regexp, len(config.Encrypt))
 	for i, pattern := range config.Encrypt {
 		compiledRegex[i] = regexp.MustCompile(pattern)
 	}
 
+	// Use the default workspace unless one is specified.
+	if workspace == "" {
+		workspace = elasticop.DefaultWorkspace
+	}
+	author, _ := ctx.Value(userContextKey).(string)
+
 	// Initialize the Elasticsearch client.
 	var elastic = &elasticop.Elastic{
-		CaCert:  config.Elasticsearch.CaCertPath,
-		Project: v["project"],
-		Encrypt: compiledRegex,
-		Logger:  logger,
+		CaCert:           config.Elasticsearch.CaCertPath,
+		BulkBatchSize:    config.Elasticsearch.BulkBatchSize,
+		BulkFlushBytes:   config.Elasticsearch.BulkFlushBytes,
+		Project:          project,
+		Workspace:        workspace,
+		Author:           author,
+		Encrypt:          compiledRegex,
+		EncryptSensitive: config.EncryptSensitive,
+		Logger:           logger,
 	}
 
 	// Connect to the Elasticsearch cluster.
-	err := elastic.ConnectCluster(r.Context())
+	if err := elastic.ConnectCluster(ctx); err != nil {
+		logger.Error("Failed to initialize Elasticsearch client", zap.Error(err), zap.String("project", project))
+		return nil, err
+	}
+
+	return elastic, nil
+}
+
+// connectElastic initializes the Elasticsearch client for the project and workspace of the request
+// and connects to the cluster.
+func connectElastic(r *http.Request) (*elasticop.Elastic, error) {
+	return newElastic(r.Context(), mux.Vars(r)["project"], r.URL.Query().Get("workspace"))
+}
+
+// stateHandler is the main handler for managing terraform state in Elasticsearch.
+func stateHandler(w http.ResponseWriter, r *http.Request) {
+	elastic, err := connectElastic(r)
 	if err != nil {
-		logger.Error("Failed to initialize Elasticsearch client", zap.Error(err), zap.String("project", v["project"]))
 		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
 		return
 	}
@@ -47,6 +74,8 @@ func stateHandler(w http.ResponseWriter, r *http.Request) {
 		Lock(w, r, elastic)
 	case "UNLOCK":
 		Unlock(w, r, elastic)
+	case "DELETE":
+		Delete(w, r, elastic)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
@@ -66,7 +95,44 @@ func Get(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
 }
 
 // Post updates the terraform state in Elasticsearch.
+// If the project is locked, only the holder identified by the ID query parameter may write the state,
+// and each write extends the lease of the lock.
+// Administrators can bypass the lineage and serial checks with the 'X-Force-Push: true' header.
 func Post(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
+	user := requestUser(r)
+	force := r.Header.Get("X-Force-Push") == "true"
+	if force && !isAdmin(user) {
+		logger.Warn("Force push denied", zap.String("user", user), zap.String("project", e.Project))
+		http.Error(w, "Only administrators can force push the state", http.StatusForbidden)
+		return
+	}
+
+	lock, err := e.GetLock()
+	if err != nil {
+		logger.Error("Failed to check the lock", zap.Error(err))
+		http.Error(w, "Failed to check the lock", http.StatusInternalServerError)
+		return
+	}
+	if lock != nil && lock.Info.ID != r.URL.Query().Get("ID") {
+		logger.Warn("Refusing to store state, project is locked by another client", zap.String("project", e.Project), zap.String("lock_id", lock.Info.ID))
+		writeLockInfo(w, http.StatusLocked, lock)
+		return
+	}
+
+	// Terraform doesn't renew the lock, so every write of the holder extends the lease, which then only
+	// has to outlast the time between two writes rather than the whole apply.
+	if lock != nil && lock.Expires != nil {
+		if _, err := e.ExtendLease(lock); errors.Is(err, elasticop.ErrLockChanged) {
+			logger.Warn("Refusing to store state, lock was changed concurrently", zap.String("project", e.Project), zap.String("lock_id", lock.Info.ID))
+			http.Error(w, "Failed to store state, lock was changed concurrently", http.StatusConflict)
+			return
+		} else if err != nil {
+			logger.Error("Failed to extend the lease of the lock", zap.Error(err))
+			http.Error(w, "Failed to extend the lease of the lock", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	updatedState, err := io.ReadAll(r.Body)
 	if err != nil {
 		logger.Error("Failed to read state from the request", zap.Error(err))
@@ -74,36 +140,141 @@ func Post(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
 		return
 	}
 
-	httpStatus, err := e.StoreState(updatedState)
+	httpStatus, err := e.StoreState(updatedState, force)
 	if err != nil {
 		logger.Error("Failed to store state in Elasticsearch", zap.Error(err))
 		http.Error(w, err.Error(), httpStatus)
 		return
 	}
 
+	// Record who overrode the checks.
+	if force {
+		if err := e.WriteAudit("force-push", user, r.Header.Get("X-Force-Push-Reason"), nil); err != nil {
+			logger.Error("Failed to write audit record", zap.Error(err))
+		}
+	}
+
+	// Remove the versions the retention policy doesn't keep.
+	schedulePrune(e)
+
 	logger.Info("Successfully stored state", zap.String("project", e.Project))
 	w.WriteHeader(http.StatusOK)
 }
 
+// Delete removes the terraform state from Elasticsearch by storing a tombstone as its latest version.
+// The state can't be deleted while it is locked.
+func Delete(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
+	lock, err := e.GetLock()
+	if err != nil {
+		logger.Error("Failed to check the lock", zap.Error(err))
+		http.Error(w, "Failed to check the lock", http.StatusInternalServerError)
+		return
+	}
+	if lock != nil {
+		logger.Warn("Refusing to delete state, project is locked", zap.String("project", e.Project), zap.String("lock_id", lock.Info.ID))
+		writeLockInfo(w, http.StatusLocked, lock)
+		return
+	}
+
+	httpStatus, err := e.DeleteState()
+	if err != nil {
+		logger.Error("Failed to delete state in Elasticsearch", zap.Error(err))
+		http.Error(w, err.Error(), httpStatus)
+		return
+	}
+
+	logger.Info("Successfully deleted state", zap.String("project", e.Project))
+	w.WriteHeader(http.StatusOK)
+}
+
 // Lock attempts to acquire a distributed lock for the specified project.
+// The request body carries the Terraform lock info, which is stored alongside the lock.
+// If the request asks to wait, it is queued behind other waiters and retries until the wait duration passes.
 func Lock(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
-	// instanceID := "unique-instance-id" // replace this with a real, unique instance ID for your application
-	acquired, err := e.AcquireLock(e.Project, r.RemoteAddr)
+	var info elasticop.LockInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		logger.Warn("Failed to parse lock info", zap.Error(err))
+		http.Error(w, "Invalid lock info", http.StatusBadRequest)
+		return
+	}
+
+	var acquired bool
+	var holder *elasticop.ESDistributedLock
+	var err error
+	if wait := lockWaitDuration(r); wait > 0 {
+		acquired, holder, err = waitForLock(r, e, info, wait)
+	} else {
+		acquired, holder, err = e.AcquireLock(r.RemoteAddr, info)
+	}
 	if err != nil {
 		logger.Error("Failed to acquire lock", zap.Error(err))
 		http.Error(w, "Failed to acquire lock", http.StatusInternalServerError)
 		return
 	}
 	if !acquired {
-		http.Error(w, "State is locked by another instance", http.StatusLocked)
+		e.RecordLockEvent(elasticop.LockEventContention, "denied", holder, &info)
+
+		// Return the current holder so Terraform can report it to the user.
+		if holder == nil {
+			http.Error(w, "State is locked by another instance", http.StatusLocked)
+			return
+		}
+		writeLockInfo(w, http.StatusLocked, holder)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
 
 // Unlock attempts to release a distributed lock for the specified project.
+// If the request body carries lock info, its ID must match the ID of the current lock.
+// An empty body, as sent by 'terraform force-unlock', releases the lock unconditionally.
 func Unlock(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
-	released, err := e.ReleaseLock(e.Project)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("Failed to read lock info from the request", zap.Error(err))
+		http.Error(w, "Error reading lock info", http.StatusInternalServerError)
+		return
+	}
+
+	// Read the current lock, so it is only released if it is still the same lock.
+	lock, err := e.GetLock()
+	if err != nil {
+		logger.Error("Failed to check the lock", zap.Error(err))
+		http.Error(w, "Failed to release lock", http.StatusInternalServerError)
+		return
+	}
+	if lock == nil {
+		http.Error(w, "Failed to release lock, lock does not exist", http.StatusNotFound)
+		return
+	}
+
+	if len(body) > 0 {
+		var info elasticop.LockInfo
+		if err := json.Unmarshal(body, &info); err != nil {
+			logger.Warn("Failed to parse lock info", zap.Error(err))
+			http.Error(w, "Invalid lock info", http.StatusBadRequest)
+			return
+		}
+
+		// Verify that the caller holds the lock before releasing it.
+		if lock.Info.ID != info.ID {
+			logger.Warn("Refusing to release lock held by another client", zap.String("project", e.Project), zap.String("lock_id", lock.Info.ID), zap.String("requested_id", info.ID))
+			writeLockInfo(w, http.StatusConflict, lock)
+			return
+		}
+	}
+
+	// Releasing without lock info is a force-unlock.
+	release := e.ReleaseLock
+	if len(body) == 0 {
+		release = e.ForceReleaseLock
+	}
+
+	released, err := release(lock)
+	if errors.Is(err, elasticop.ErrLockChanged) {
+		http.Error(w, "Failed to release lock, lock was changed concurrently", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		logger.Error("Failed to release lock", zap.Error(err))
 		http.Error(w, "Failed to release lock", http.StatusInternalServerError)
@@ -113,5 +284,44 @@ func Unlock(w http.ResponseWriter, r *http.Request, e *elasticop.Elastic) {
 		http.Error(w, "Failed to release lock, lock does not exist", http.StatusNotFound)
 		return
 	}
+
+	// Let the next waiting request retry right away.
+	notifyLockReleased(lockQueueKey(e))
 	w.WriteHeader(http.StatusOK)
 }
+
+// writeJSON responds with the given value encoded as JSON.
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logger.Error("Failed to write the response", zap.Error(err))
+	}
+}
+
+// writeLockInfo responds with the given status and the Terraform lock info of the current lock holder.
+func writeLockInfo(w http.ResponseWriter, status int, lock *elasticop.ESDistributedLock) {
+	writeJSON(w, status, lock.Info)
+}
+
+// renewHandler extends the lease of the lock held by the caller identified by the ID query parameter.
+func renewHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	lock, err := e.RenewLock(r.URL.Query().Get("ID"))
+	if errors.Is(err, elasticop.ErrLockNotHeld) || errors.Is(err, elasticop.ErrLockChanged) {
+		http.Error(w, "Failed to renew lock, lock is not held by the caller", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to renew lock", zap.Error(err))
+		http.Error(w, "Failed to renew lock", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, lock)
+}
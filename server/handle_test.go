@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/levente-simon/terraform-elastic-backend/elasticop"
+	"go.uber.org/zap"
+)
+
+// fakeElasticsearch stores the documents written by the handlers in memory. Searches find nothing,
+// so it only serves handlers which read documents by their ID.
+type fakeElasticsearch struct {
+	mu        sync.Mutex
+	documents map[string]map[string]map[string]interface{}
+	seqNo     int
+	requests  int
+}
+
+// newHandlerTest starts a fake Elasticsearch and returns a client of it for the project,
+// with the given administrators configured.
+func newHandlerTest(t *testing.T, project string, admins ...string) (*elasticop.Elastic, *fakeElasticsearch) {
+	t.Helper()
+	logger = zap.NewNop()
+	previous := *config
+	config.Admin.Users = admins
+	t.Cleanup(func() { *config = previous })
+
+	fake := &fakeElasticsearch{documents: map[string]map[string]map[string]interface{}{}}
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{server.URL}})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err)
+	}
+	return &elasticop.Elastic{
+		Client:           client,
+		Ctx:              context.Background(),
+		Addresses:        []string{server.URL},
+		StateIndex:       "terraform-state",
+		ResourceIndex:    "terraform-resources",
+		PointerIndex:     "terraform-state-pointers",
+		LockIndex:        "terraform-locks",
+		LockHistoryIndex: "terraform-lock-history",
+		AuditIndex:       "terraform-audit",
+		Project:          project,
+		Workspace:        elasticop.DefaultWorkspace,
+		Logger:           logger,
+	}, fake
+}
+
+// index returns the documents stored in the index.
+func (f *fakeElasticsearch) index(name string) map[string]map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.documents[name]
+}
+
+// store saves the document and returns its sequence number. It must be called with the lock held.
+func (f *fakeElasticsearch) store(index, id string, source map[string]interface{}) int {
+	if f.documents[index] == nil {
+		f.documents[index] = map[string]map[string]interface{}{}
+	}
+	f.seqNo++
+	if id == "" {
+		id = "auto-" + strconv.Itoa(f.seqNo)
+	}
+	f.documents[index][id] = source
+	return f.seqNo
+}
+
+// serve handles the requests of the client.
+func (f *fakeElasticsearch) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+
+	var body bytes.Buffer
+	body.ReadFrom(r.Body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case parts[0] == "_bulk":
+		f.bulk(w, body.Bytes())
+	case parts[0] == "_pit":
+		fmt.Fprint(w, `{"succeeded":true}`)
+	case len(parts) == 1 && r.Method == http.MethodHead:
+		if f.documents[parts[0]] == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case len(parts) == 1:
+		if f.documents[parts[0]] == nil {
+			f.documents[parts[0]] = map[string]map[string]interface{}{}
+		}
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case parts[len(parts)-1] == "_search":
+		fmt.Fprint(w, `{"hits":{"total":{"value":0},"hits":[]}}`)
+	case parts[len(parts)-1] == "_pit":
+		fmt.Fprint(w, `{"id":"pit"}`)
+	case parts[len(parts)-1] == "_delete_by_query":
+		fmt.Fprint(w, `{"deleted":0}`)
+	case len(parts) == 2 && parts[1] != "_doc":
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case len(parts) >= 2 && r.Method == http.MethodGet:
+		source, ok := f.documents[parts[0]][parts[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"found":false}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"_id": parts[2], "_seq_no": f.seqNo, "_primary_term": 1, "found": true, "_source": source})
+	case len(parts) >= 2 && r.Method == http.MethodDelete:
+		delete(f.documents[parts[0]], parts[2])
+		fmt.Fprint(w, `{"result":"deleted"}`)
+	default:
+		id := ""
+		if len(parts) == 3 {
+			id = parts[2]
+		}
+		if _, exists := f.documents[parts[0]][id]; exists && (parts[1] == "_create" || r.URL.Query().Get("op_type") == "create") {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprint(w, `{"error":{"type":"version_conflict_engine_exception"},"status":409}`)
+			return
+		}
+		var source map[string]interface{}
+		if err := json.Unmarshal(body.Bytes(), &source); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		seqNo := f.store(parts[0], id, source)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"_id":%q,"_seq_no":%d,"_primary_term":1,"result":"created"}`, id, seqNo)
+	}
+}
+
+// bulk stores the documents of bulk index and create actions.
+func (f *fakeElasticsearch) bulk(w http.ResponseWriter, body []byte) {
+	var items []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var action map[string]map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &action); err != nil || !scanner.Scan() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var source map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &source)
+		for name, meta := range action {
+			index, _ := meta["_index"].(string)
+			id, _ := meta["_id"].(string)
+			f.store(index, id, source)
+			items = append(items, map[string]interface{}{name: map[string]interface{}{"_index": index, "status": http.StatusCreated}})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+}
+
+// postState sends the state to the Post handler as the given user, with the given headers.
+func postState(e *elasticop.Elastic, user, state string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/state/"+e.Project, strings.NewReader(state))
+	r = r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+	for key, value := range headers {
+		r.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	Post(w, r, e)
+	return w
+}
+
+const testState = `{"version": 4, "lineage": "lineage", "serial": 1, "outputs": {}, "resources": []}`
+
+func TestPostForcePushRequiresAdmin(t *testing.T) {
+	e, fake := newHandlerTest(t, "app", "admin")
+
+	// The override is refused before anything is read or written.
+	w := postState(e, "developer", testState, map[string]string{"X-Force-Push": "true"})
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("expected a forced write by a non-administrator to be forbidden, got %d: %s", w.Code, w.Body)
+	}
+	if fake.requests != 0 {
+		t.Fatalf("expected no requests to Elasticsearch, got %d", fake.requests)
+	}
+}
+
+func TestPostForcePushIsAudited(t *testing.T) {
+	e, fake := newHandlerTest(t, "app", "admin")
+
+	w := postState(e, "admin", testState, map[string]string{"X-Force-Push": "true", "X-Force-Push-Reason": "restore backup"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the forced write to succeed, got %d: %s", w.Code, w.Body)
+	}
+	records := fake.index("terraform-audit")
+	if len(records) != 1 {
+		t.Fatalf("expected a single audit record, got %d", len(records))
+	}
+	for _, record := range records {
+		if record["action"] != "force-push" || record["user"] != "admin" || record["reason"] != "restore backup" || record["project"] != "app" {
+			t.Fatalf("unexpected audit record %v", record)
+		}
+	}
+}
+
+func TestPostWithoutForceIsNotAudited(t *testing.T) {
+	e, fake := newHandlerTest(t, "app", "admin")
+
+	// Regular writes, also by administrators, are not audited.
+	w := postState(e, "admin", testState, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the write to succeed, got %d: %s", w.Code, w.Body)
+	}
+	if records := fake.index("terraform-audit"); len(records) != 0 {
+		t.Fatalf("expected no audit records, got %d", len(records))
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/levente-simon/terraform-elastic-backend/elasticop"
+	"go.uber.org/zap"
+)
+
+// lockWaiter is a request waiting in the queue for the lock of a project and workspace.
+type lockWaiter struct {
+	// turn is closed when the waiter reaches the head of the queue.
+	turn chan struct{}
+
+	// released is signaled when the lock is released through this server.
+	released chan struct{}
+}
+
+var (
+	// lockQueues holds the FIFO queue of waiters for each project and workspace.
+	// The queues only order the requests waiting on this instance. Requests waiting on different instances
+	// of the backend compete for the lock when it is released, as the lock document is the only shared state.
+	lockQueues   = map[string][]*lockWaiter{}
+	lockQueuesMu sync.Mutex
+)
+
+// lockQueueKey returns the key of the lock queue of the project and workspace.
+func lockQueueKey(e *elasticop.Elastic) string {
+	return e.Project + "@" + e.Workspace
+}
+
+// joinLockQueue appends a new waiter to the end of the queue.
+func joinLockQueue(key string) *lockWaiter {
+	lockQueuesMu.Lock()
+	defer lockQueuesMu.Unlock()
+
+	waiter := &lockWaiter{
+		turn:     make(chan struct{}),
+		released: make(chan struct{}, 1),
+	}
+	lockQueues[key] = append(lockQueues[key], waiter)
+	if len(lockQueues[key]) == 1 {
+		close(waiter.turn)
+	}
+	return waiter
+}
+
+// leaveLockQueue removes the waiter from the queue and hands the turn to the next waiter if it was at the head.
+func leaveLockQueue(key string, waiter *lockWaiter) {
+	lockQueuesMu.Lock()
+	defer lockQueuesMu.Unlock()
+
+	queue := lockQueues[key]
+	for i, w := range queue {
+		if w != waiter {
+			continue
+		}
+		queue = append(queue[:i], queue[i+1:]...)
+		if i == 0 && len(queue) > 0 {
+			close(queue[0].turn)
+		}
+		break
+	}
+
+	if len(queue) == 0 {
+		delete(lockQueues, key)
+	} else {
+		lockQueues[key] = queue
+	}
+}
+
+// notifyLockReleased wakes up the waiter at the head of the queue, so it retries without waiting for the next poll.
+func notifyLockReleased(key string) {
+	lockQueuesMu.Lock()
+	defer lockQueuesMu.Unlock()
+
+	if queue := lockQueues[key]; len(queue) > 0 {
+		select {
+		case queue[0].released <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// lockWaitDuration returns how long the request is willing to wait for the lock.
+// It is read from the 'wait' query parameter or the 'X-Lock-Wait' header, either as a duration
+// or as a number of seconds, and is bounded by the configured maximum.
+func lockWaitDuration(r *http.Request) time.Duration {
+	value := r.URL.Query().Get("wait")
+	if value == "" {
+		value = r.Header.Get("X-Lock-Wait")
+	}
+	if value == "" {
+		return 0
+	}
+
+	wait, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			logger.Warn("Ignoring invalid lock wait duration", zap.String("value", value))
+			return 0
+		}
+		wait = time.Duration(seconds) * time.Second
+	}
+
+	if wait > config.Lock.MaxWait {
+		wait = config.Lock.MaxWait
+	}
+	return wait
+}
+
+// waitForLock queues the request behind other waiters of the same project and workspace on this instance,
+// and once it is at the head of the queue, it retries acquiring the lock until it succeeds or the wait
+// duration passes.
+// It returns whether the lock was acquired, and the current holder otherwise.
+func waitForLock(r *http.Request, e *elasticop.Elastic, info elasticop.LockInfo, wait time.Duration) (bool, *elasticop.ESDistributedLock, error) {
+	key := lockQueueKey(e)
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	waiter := joinLockQueue(key)
+	defer leaveLockQueue(key, waiter)
+
+	// Wait for the requests queued earlier to finish.
+	select {
+	case <-waiter.turn:
+	case <-deadline.C:
+		holder, err := e.GetLock()
+		return false, holder, err
+	case <-r.Context().Done():
+		return false, nil, r.Context().Err()
+	}
+
+	poll := time.NewTicker(config.Lock.PollInterval)
+	defer poll.Stop()
+
+	for {
+		acquired, holder, err := e.AcquireLock(r.RemoteAddr, info)
+		if err != nil || acquired {
+			return acquired, nil, err
+		}
+
+		// Retry on the next poll, or as soon as the lock is released through this server.
+		select {
+		case <-poll.C:
+		case <-waiter.released:
+		case <-deadline.C:
+			logger.Info("Timed out waiting for lock", zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.Duration("wait", wait))
+			return false, holder, nil
+		case <-r.Context().Done():
+			return false, holder, r.Context().Err()
+		}
+	}
+}
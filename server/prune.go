@@ -0,0 +1,113 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/levente-simon/terraform-elastic-backend/elasticop"
+	"github.com/levente-simon/terraform-elastic-backend/vaultop"
+	"go.uber.org/zap"
+)
+
+var (
+	// pruneQueue holds the projects waiting to be pruned by the background worker.
+	pruneQueue = make(chan *elasticop.Elastic, 100)
+
+	// lastPruned records when each project and workspace was last scheduled for pruning.
+	lastPruned   = map[string]time.Time{}
+	lastPrunedMu sync.Mutex
+)
+
+// schedulePrune queues the project for pruning by the background worker if it has a retention policy
+// and wasn't scheduled within the configured interval. The project is skipped if the queue is full.
+func schedulePrune(e *elasticop.Elastic) {
+	if !config.Retention.Background || !e.RetentionEnabled() {
+		return
+	}
+
+	key := lockQueueKey(e)
+	lastPrunedMu.Lock()
+	if time.Since(lastPruned[key]) < config.Retention.Interval {
+		lastPrunedMu.Unlock()
+		return
+	}
+	lastPruned[key] = time.Now()
+	lastPrunedMu.Unlock()
+
+	// The request context is canceled once the response is written, so the worker uses a detached copy.
+	job := *e
+	job.Ctx = context.WithoutCancel(e.Ctx)
+
+	select {
+	case pruneQueue <- &job:
+	default:
+		logger.Warn("Prune queue is full, skipping project", zap.String("project", e.Project), zap.String("workspace", e.Workspace))
+	}
+}
+
+// pruneWorker prunes the queued projects one by one.
+func pruneWorker() {
+	for e := range pruneQueue {
+		if _, err := e.PruneVersions(false); err != nil {
+			logger.Error("Failed to prune state versions", zap.String("project", e.Project), zap.String("workspace", e.Workspace), zap.Error(err))
+		}
+	}
+}
+
+// pruneSweeper schedules the pruning of every project at the configured interval, so projects which
+// aren't written anymore are pruned as well.
+func pruneSweeper() {
+	ticker := time.NewTicker(config.Retention.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := sweepProjects(); err != nil {
+			logger.Error("Failed to sweep projects for pruning", zap.Error(err))
+		}
+	}
+}
+
+// sweepProjects schedules the pruning of each workspace of the projects stored in Vault which have a
+// retention policy.
+func sweepProjects() error {
+	// Authenticate with the credentials of the sweep.
+	vaultClient := newVaultClient()
+	isAuthenticated, err := vaultClient.BasicAuth(config.Retention.Username, config.Retention.Password, config.Vault.UserPassPath)
+	if err != nil || !isAuthenticated {
+		return fmt.Errorf("failed to authenticate with Vault: %v", err)
+	}
+
+	projects, err := vaultClient.ListProjects()
+	if err != nil {
+		return fmt.Errorf("failed to list projects: %s", err)
+	}
+
+	ctx := context.WithValue(context.Background(), vaultop.VaultClientKey, vaultClient)
+	ctx = context.WithValue(ctx, userContextKey, config.Retention.Username)
+	for _, project := range projects {
+		// Skip the projects without a retention policy.
+		e, err := newElastic(ctx, project, "")
+		if err != nil {
+			logger.Warn("Failed to connect to the project, skipping it", zap.String("project", project), zap.Error(err))
+			continue
+		}
+		if !e.RetentionEnabled() {
+			continue
+		}
+
+		workspaces, err := e.ListWorkspaces()
+		if err != nil {
+			logger.Warn("Failed to list the workspaces, skipping the project", zap.String("project", project), zap.Error(err))
+			continue
+		}
+		for _, workspace := range workspaces {
+			job := *e
+			job.Workspace = workspace
+			schedulePrune(&job)
+		}
+	}
+
+	return nil
+}
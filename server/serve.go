@@ -25,6 +25,22 @@ func ServeHttp(configFilePath string, loggerArg *zap.Logger) error {
 	}
 
 	r.HandleFunc("/state/{project}", basicAuth(stateHandler))
+	r.HandleFunc("/state/{project}/renew", basicAuth(renewHandler)).Methods("POST")
+	r.HandleFunc("/state/{project}/versions", basicAuth(versionsHandler)).Methods("GET")
+	r.HandleFunc("/state/{project}/versions/{id}", basicAuth(versionHandler)).Methods("GET")
+	r.HandleFunc("/state/{project}/diff", basicAuth(diffHandler)).Methods("GET")
+	r.HandleFunc("/admin/locks", adminAuth(listAllLocksHandler)).Methods("GET")
+	r.HandleFunc("/admin/{project}/locks", adminAuth(listLocksHandler)).Methods("GET")
+	r.HandleFunc("/admin/{project}/unlock", adminAuth(forceUnlockHandler)).Methods("POST")
+	r.HandleFunc("/admin/{project}/rollback", adminAuth(rollbackHandler)).Methods("POST")
+	r.HandleFunc("/admin/{project}/encryption", adminAuth(encryptionRulesHandler)).Methods("GET")
+	r.HandleFunc("/admin/{project}/rewrap", adminAuth(rewrapHandler)).Methods("POST")
+
+	// Prune old state versions in the background, sweeping all projects if credentials are configured.
+	go pruneWorker()
+	if config.Retention.Background && config.Retention.Username != "" {
+		go pruneSweeper()
+	}
 
 	exitCh := make(chan error, 2) // Channel size of 2 to handle both HTTP and HTTPS errors
 
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/levente-simon/terraform-elastic-backend/elasticop"
+	"go.uber.org/zap"
+)
+
+// Page sizes of the version listing.
+const (
+	defaultVersionPageSize = 20
+	maxVersionPageSize     = 100
+)
+
+// versionList is the response of the version listing.
+type versionList struct {
+	Total    int64                    `json:"total"`
+	Size     int                      `json:"size"`
+	Next     string                   `json:"next,omitempty"`
+	Versions []elasticop.StateVersion `json:"versions"`
+}
+
+// versionsHandler lists the committed versions of the state, newest first.
+// The page size is set with the 'size' query parameter, and the following pages are requested by passing
+// the 'next' cursor of the previous page as the 'after' query parameter.
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	size, err := queryInt(r, "size", defaultVersionPageSize)
+	if err != nil || size < 1 {
+		http.Error(w, "Invalid 'size' parameter", http.StatusBadRequest)
+		return
+	}
+	if size > maxVersionPageSize {
+		size = maxVersionPageSize
+	}
+
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	versions, total, next, err := e.ListVersions(r.URL.Query().Get("after"), size)
+	if errors.Is(err, elasticop.ErrInvalidCursor) {
+		http.Error(w, "Invalid or expired 'after' parameter, start the listing again", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		logger.Error("Failed to list state versions", zap.Error(err))
+		http.Error(w, "Failed to list state versions", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, versionList{
+		Total:    total,
+		Size:     size,
+		Next:     next,
+		Versions: versions,
+	})
+}
+
+// versionHandler returns the state of the version identified in the URL.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	body, httpStatus, err := e.GetVersion(id)
+	if err != nil {
+		logger.Error("Failed to retrieve state version from Elasticsearch", zap.String("version", id), zap.Error(err))
+		http.Error(w, err.Error(), httpStatus)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// queryInt reads an integer query parameter, returning the default value if it is not set.
+func queryInt(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// diffHandler compares the resources of the versions given in the 'from' and 'to' query parameters.
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if from == "" || to == "" {
+		http.Error(w, "The 'from' and 'to' parameters are required", http.StatusBadRequest)
+		return
+	}
+
+	e, err := connectElastic(r)
+	if err != nil {
+		http.Error(w, "Internal server error: Elasticsearch client is not initialized", http.StatusInternalServerError)
+		return
+	}
+
+	diff, httpStatus, err := e.DiffVersions(from, to)
+	if err != nil {
+		logger.Error("Failed to compare state versions", zap.String("from", from), zap.String("to", to), zap.Error(err))
+		http.Error(w, err.Error(), httpStatus)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diff)
+}
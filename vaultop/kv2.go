@@ -2,10 +2,12 @@ package vaultop
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -33,6 +35,36 @@ func (v *Vault) GetKv2Secret(mountPath string, secretPath string) (map[string]in
 	return secret.Data, nil
 }
 
+// ListKv2Secrets lists the names of the KV version 2 secrets stored directly under the mount path.
+// Nested paths are not listed.
+func (v *Vault) ListKv2Secrets(mountPath string) ([]string, error) {
+	// List the metadata of the secrets, which holds their names.
+	secret, err := v.Client.Logical().List(strings.TrimSuffix(mountPath, "/") + "/metadata")
+	if err != nil {
+		v.Logger.Error("Error listing secrets in Vault", zap.String("mountPath", mountPath), zap.Error(err))
+		return nil, fmt.Errorf("error listing vault secrets")
+	}
+	if secret == nil {
+		return []string{}, nil
+	}
+
+	keys, _ := secret.Data["keys"].([]interface{})
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		name, ok := key.(string)
+		if !ok || strings.HasSuffix(name, "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// ListProjects lists the projects whose configuration is stored in Vault.
+func (v *Vault) ListProjects() ([]string, error) {
+	return v.ListKv2Secrets(v.KvMountPath)
+}
+
 // GetConfig maps configuration data from Vault into the provided 'config' structure.
 // It dynamically reads the 'vault' and 'default' struct tags to know where to pull data from Vault
 // and where to set default values if the data is missing in Vault.
@@ -74,19 +106,61 @@ func (v *Vault) GetConfig(secretPath string, config interface{}) error {
 			case reflect.String:
 				field.SetString(fmt.Sprintf("%v", value))
 			case reflect.Slice:
-				str, ok := value.(string)
-				if ok {
-					field.Set(reflect.ValueOf(strings.Split(str, ",")))
+				switch typed := value.(type) {
+				case string:
+					field.Set(reflect.ValueOf(strings.Split(typed, ",")))
+				case []interface{}:
+					// Lists given as JSON arrays, for values which may contain commas.
+					items := make([]string, 0, len(typed))
+					for _, item := range typed {
+						items = append(items, fmt.Sprintf("%v", item))
+					}
+					field.Set(reflect.ValueOf(items))
 				}
 			case reflect.Int:
+				// Numbers stored as JSON numbers are decoded as json.Number, or as float64 by other clients.
+				var intVal int64
+				var err error
+				switch typed := value.(type) {
+				case string:
+					intVal, err = strconv.ParseInt(typed, 10, 64)
+				case json.Number:
+					intVal, err = typed.Int64()
+				case float64:
+					intVal = int64(typed)
+					if float64(intVal) != typed {
+						err = fmt.Errorf("%v is not an integer", typed)
+					}
+				default:
+					err = fmt.Errorf("unsupported type %T", value)
+				}
+				if err != nil {
+					v.Logger.Error("Error converting value to integer", zap.String("key", tag), zap.Any("value", value), zap.Error(err))
+					return fmt.Errorf("error converting %s to integer: %s", tag, err)
+				}
+				field.SetInt(intVal)
+			case reflect.Bool:
+				switch typed := value.(type) {
+				case bool:
+					field.SetBool(typed)
+				case string:
+					boolVal, err := strconv.ParseBool(typed)
+					if err != nil {
+						v.Logger.Error("Error converting value to boolean", zap.String("value", typed), zap.Error(err))
+						return err
+					}
+					field.SetBool(boolVal)
+				}
+			case reflect.Int64:
+				// Durations are given in Go duration format, e.g. "30m".
 				str, ok := value.(string)
-				if ok {
-					intVal, err := strconv.Atoi(str)
+				if ok && field.Type() == reflect.TypeOf(time.Duration(0)) {
+					duration, err := time.ParseDuration(str)
 					if err != nil {
-						v.Logger.Error("Error converting value to integer", zap.String("value", str), zap.Error(err))
+						v.Logger.Error("Error converting value to duration", zap.String("value", str), zap.Error(err))
 						return err
 					}
-					field.SetInt(int64(intVal))
+					field.SetInt(int64(duration))
 				}
 			}
 		}
@@ -2,8 +2,13 @@ package vaultop
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"sync"
 
+	vault "github.com/hashicorp/vault/api"
 	"go.uber.org/zap"
 )
 
@@ -63,3 +68,191 @@ func (v *Vault) DecryptWithVault(ciphertext, key string) (string, error) {
 
 	return string(decodedValue), nil
 }
+
+// Defaults of the Transit batch settings, used when they are not configured.
+const (
+	defaultTransitBatchSize   = 100
+	defaultTransitParallelism = 4
+)
+
+// BatchResult is the result of a single item of a batch operation.
+type BatchResult struct {
+	// Value is the ciphertext or the plaintext of the item, if the operation succeeded.
+	Value string
+
+	// Err is set if the operation failed for the item, because Vault rejected the item or because the
+	// request holding it failed.
+	Err error
+}
+
+// EncryptBatchWithVault uses Vault's Transit secret engine to encrypt the given values with the key,
+// sending them in batches. It returns the result of each value in the order of the values. Failures, including
+// failed requests, are reported in the results of the values they affect, so the returned error is always nil.
+func (v *Vault) EncryptBatchWithVault(values []string, key string) ([]BatchResult, error) {
+	items := make([]map[string]interface{}, len(values))
+	for i, value := range values {
+		items[i] = map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString([]byte(value)),
+		}
+	}
+	return v.transitBatch("encrypt", key, items, "ciphertext", nil)
+}
+
+// DecryptBatchWithVault uses Vault's Transit secret engine to decrypt the given ciphertexts with the key,
+// sending them in batches. It returns the result of each ciphertext in the order of the ciphertexts. Failures,
+// including failed requests, are reported in the results of the values they affect, so the returned error is always nil.
+func (v *Vault) DecryptBatchWithVault(ciphertexts []string, key string) ([]BatchResult, error) {
+	items := make([]map[string]interface{}, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		items[i] = map[string]interface{}{
+			"ciphertext": ciphertext,
+		}
+	}
+
+	// Decode the base64 encoded plaintexts.
+	decode := func(plaintext string) (string, error) {
+		decodedValue, err := base64.StdEncoding.DecodeString(plaintext)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode the secret in vault: %v", err)
+		}
+		return string(decodedValue), nil
+	}
+	return v.transitBatch("decrypt", key, items, "plaintext", decode)
+}
+
+// RewrapBatchWithVault uses Vault's Transit secret engine to rewrap the given ciphertexts with the latest
+// version of the key, without exposing the plaintexts. It returns the result of each ciphertext in the order
+// of the ciphertexts. Failures, including failed requests, are reported in the results of the values they
+// affect, so the returned error is always nil.
+func (v *Vault) RewrapBatchWithVault(ciphertexts []string, key string) ([]BatchResult, error) {
+	items := make([]map[string]interface{}, len(ciphertexts))
+	for i, ciphertext := range ciphertexts {
+		items[i] = map[string]interface{}{
+			"ciphertext": ciphertext,
+		}
+	}
+	return v.transitBatch("rewrap", key, items, "ciphertext", nil)
+}
+
+// LatestKeyVersion returns the latest version of the Transit key, which new ciphertexts are encrypted with.
+func (v *Vault) LatestKeyVersion(key string) (int, error) {
+	secret, err := v.Client.Logical().Read(v.TransitPath + "/keys/" + key)
+	if err != nil {
+		v.Logger.Error("Error reading the key from Vault", zap.String("key", key), zap.Error(err))
+		return 0, fmt.Errorf("error reading key from Vault: %v", err)
+	}
+	if secret == nil {
+		return 0, fmt.Errorf("transit key %s does not exist", key)
+	}
+
+	// Extract the latest version from Vault's response.
+	switch version := secret.Data["latest_version"].(type) {
+	case json.Number:
+		latest, err := version.Int64()
+		if err != nil {
+			return 0, fmt.Errorf("invalid latest version in Vault response: %v", err)
+		}
+		return int(latest), nil
+	case float64:
+		return int(version), nil
+	default:
+		return 0, fmt.Errorf("failed to get latest version from Vault response")
+	}
+}
+
+// transitBatch sends the items to the Transit operation in chunks of the configured batch size,
+// with at most the configured number of requests in parallel. The result field of each item is
+// converted with the convert function, if given.
+func (v *Vault) transitBatch(operation, key string, items []map[string]interface{}, resultField string, convert func(string) (string, error)) ([]BatchResult, error) {
+	batchSize := v.TransitBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultTransitBatchSize
+	}
+	parallelism := v.TransitParallelism
+	if parallelism <= 0 {
+		parallelism = defaultTransitParallelism
+	}
+
+	results := make([]BatchResult, len(items))
+	semaphore := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for start := 0; start < len(items); start += batchSize {
+		end := start + batchSize
+		if end > len(items) {
+			end = len(items)
+		}
+
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(start, end int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			v.transitChunk(operation, key, items[start:end], resultField, convert, results[start:end])
+		}(start, end)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// transitChunk sends a single batch request to the Transit operation and stores the results of its items.
+// Vault rejects the whole batch with 400 Bad Request if any of its items fails, so the items of a rejected
+// batch are sent again one by one, to tell the failed items from the others.
+func (v *Vault) transitChunk(operation, key string, items []map[string]interface{}, resultField string, convert func(string) (string, error), results []BatchResult) {
+	// fail reports the error for every item of the chunk.
+	fail := func(err error) {
+		for i := range results {
+			results[i].Err = err
+		}
+	}
+
+	// Write the batch to Vault's Transit secret engine.
+	secret, err := v.Client.Logical().Write(v.TransitPath+"/"+operation+"/"+key, map[string]interface{}{
+		"batch_input": items,
+	})
+	var responseErr *vault.ResponseError
+	if err != nil && len(items) > 1 && errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusBadRequest {
+		v.Logger.Warn("Vault rejected the batch, sending its items one by one", zap.String("operation", operation), zap.String("key", key), zap.Int("items", len(items)))
+		for i := range items {
+			v.transitChunk(operation, key, items[i:i+1], resultField, convert, results[i:i+1])
+		}
+		return
+	}
+	if err != nil {
+		v.Logger.Error("Error sending batch to Vault", zap.String("operation", operation), zap.String("key", key), zap.Int("items", len(items)), zap.Error(err))
+		fail(fmt.Errorf("error in Vault batch %s: %v", operation, err))
+		return
+	}
+	if secret == nil {
+		fail(fmt.Errorf("empty response from Vault batch %s", operation))
+		return
+	}
+
+	// Extract the results from Vault's response.
+	batchResults, ok := secret.Data["batch_results"].([]interface{})
+	if !ok || len(batchResults) != len(items) {
+		fail(fmt.Errorf("failed to get batch results from Vault response"))
+		return
+	}
+	for i, item := range batchResults {
+		result, _ := item.(map[string]interface{})
+		if message, _ := result["error"].(string); message != "" {
+			results[i].Err = fmt.Errorf("error in Vault batch %s: %s", operation, message)
+			continue
+		}
+		value, ok := result[resultField].(string)
+		if !ok {
+			results[i].Err = fmt.Errorf("failed to get %s from Vault response", resultField)
+			continue
+		}
+		if convert != nil {
+			value, err = convert(value)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+		}
+		results[i].Value = value
+	}
+}
@@ -37,6 +37,12 @@ type Vault struct {
 	// TransitPath is the path for the transit secret engine.
 	TransitPath string
 
+	// TransitBatchSize is the maximum number of values sent to the transit secret engine in a single request.
+	TransitBatchSize int
+
+	// TransitParallelism is the maximum number of batch requests sent to the transit secret engine in parallel.
+	TransitParallelism int
+
 	// Logger is the zap logger instance for logging Vault-related operations.
 	Logger *zap.Logger
 }